@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// AWSConfig is shared by every AWS client tasque creates
+type AWSConfig struct {
+	Region  string
+	Profile string
+	// RoleARN is assumed on top of the profile's or environment's
+	// credentials, with ExternalID when the role's trust policy wants one
+	RoleARN    string
+	ExternalID string
+	// Endpoints replace the services' own, e.g. ElasticMQ for SQS or Step
+	// Functions Local for SFN
+	SQSEndpoint string
+	SFNEndpoint string
+	ECSEndpoint string
+	S3Endpoint  string
+
+	once sync.Once
+	sess *session.Session
+	err  error
+}
+
+// session is created once so that the role is only assumed once, the
+// credentials refresh themselves
+func (config *AWSConfig) session() (*session.Session, error) {
+	config.once.Do(func() {
+		options := session.Options{
+			Profile:           config.Profile,
+			SharedConfigState: session.SharedConfigEnable,
+		}
+		if config.Region != "" {
+			options.Config.Region = aws.String(config.Region)
+		}
+		config.sess, config.err = session.NewSessionWithOptions(options)
+		if config.err != nil || config.RoleARN == "" {
+			return
+		}
+		credentials := stscreds.NewCredentials(config.sess, config.RoleARN, func(provider *stscreds.AssumeRoleProvider) {
+			provider.RoleSessionName = "tasque"
+			if config.ExternalID != "" {
+				provider.ExternalID = aws.String(config.ExternalID)
+			}
+		})
+		config.sess = config.sess.Copy(&aws.Config{Credentials: credentials})
+	})
+	return config.sess, config.err
+}
+
+// clientConfig points a client at endpoint, if there is one, and at
+// fallbackRegion unless a region is configured. A region that only comes
+// from the shared config file doesn't count.
+func (config *AWSConfig) clientConfig(endpoint string, fallbackRegion string) *aws.Config {
+	clientConfig := &aws.Config{}
+	if endpoint != "" {
+		clientConfig.Endpoint = aws.String(endpoint)
+	}
+	if config.Region == "" && fallbackRegion != "" {
+		clientConfig.Region = aws.String(fallbackRegion)
+	}
+	return clientConfig
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
@@ -12,7 +13,9 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,8 +27,39 @@ type AWSECS struct {
 	taskArn               string
 	handler               MessageHandler
 	timeout               time.Duration
+	payload               payloadMode
+	payloadDir            string
+	payloadFile           string
+	attributesFile        string
+	outputFile            string
 	docker                *Docker
+	aws                   *AWSConfig
 	result                result.Result
+	// running is shared with the copies Execute makes, so that alive can
+	// find the task
+	running *runningTask
+	// instance is shared with every copy, see locate
+	instance *ecsInstance
+}
+
+// ecsInstance is where the ecs command starts its tasks, looked up once
+type ecsInstance struct {
+	mu        sync.Mutex
+	placement *ecsPlacement
+}
+
+// ecsPlacement is the cluster, container instance and region of this
+// instance
+type ecsPlacement struct {
+	cluster           string
+	containerInstance string
+	region            string
+}
+
+// runningTask is the ECS task an AWSECS is waiting for
+type runningTask struct {
+	mu      sync.Mutex
+	taskArn string
 }
 
 // Docker hello world
@@ -47,116 +81,182 @@ type ECSMetadata struct {
 	Version              string `json:"Version"`
 }
 
-func (executable AWSECS) Execute(handler MessageHandler) {
+func (executable AWSECS) Execute(ctx context.Context, handler MessageHandler) {
 	executable.handler = handler
-	executable.execute(handler)
+	executable.executableTimeoutHelper(ctx, handler)
 }
 
 func (executable *AWSECS) Result() result.Result {
 	return executable.result
 }
 
-func (ecsmeta *ECSMetadata) init() {
-	client := &http.Client{}
+// alive checks that the task's containers haven't all stopped, the task may
+// still be pending before the agent creates any
+func (executable *AWSECS) alive(ctx context.Context) bool {
+	executable.running.mu.Lock()
+	taskArn := executable.running.taskArn
+	executable.running.mu.Unlock()
+	if taskArn == "" {
+		return true
+	}
+	containers, err := executable.docker.client.ListContainers(docker.ListContainersOptions{
+		All:     true,
+		Filters: map[string][]string{"label": {"com.amazonaws.ecs.task-arn=" + taskArn}},
+		Context: ctx,
+	})
+	if err != nil {
+		log.Printf("Couldn't list containers of %s %s", taskArn, err)
+		return true
+	}
+	if len(containers) == 0 {
+		return true
+	}
+	for _, container := range containers {
+		if container.State == "running" || container.State == "created" {
+			return true
+		}
+	}
+	return false
+}
+
+// clone gives a daemon worker its own Docker event channel.
+func (executable *AWSECS) clone(worker int) ExecutableInterface {
+	c := *executable
+	c.docker = &Docker{
+		client:   executable.docker.client,
+		eventsCh: make(chan *docker.APIEvents),
+	}
+	c.running = &runningTask{}
+	return &c
+}
+
+func (ecsmeta *ECSMetadata) init(ctx context.Context) error {
 	req, err := http.NewRequest("GET", "http://localhost:51678/v1/metadata", nil)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
-	resp, err := client.Do(req)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == 200 {
-		body, _ := ioutil.ReadAll(resp.Body)
-		if err := json.Unmarshal(body, &ecsmeta); err != nil {
-			fmt.Println(string(body))
-			panic(err)
-		}
-	} else {
-		panic("ECS metadata service did not return 200")
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("ECS metadata service returned %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, ecsmeta); err != nil {
+		return fmt.Errorf("ECS metadata %s %s", err, body)
 	}
+	return nil
 }
 
-// If the metadata service can't be reached, what do we do?
-// -> Retry
-// -> Alert?
-// -> Devmode
-// Currently this will run for 30 seconds and panic/die if it can't connect.
-// Devmode option skips this
-func (m *InstanceMetadata) init() *ec2metadata.EC2Metadata {
-	// Locate this instance
-	timeoutDuration, _ := time.ParseDuration("30s")
-	timeout := time.After(timeoutDuration)
-	i := 0
-	for {
-		i++
-		select {
-		default:
-			log.Printf("[INFO] Connecting metadata service (%d)", i)
-			sess, err := session.NewSession()
-			if err != nil {
-				fmt.Println("failed to create session,", err)
-				panic("failed to create session")
-			}
-
-			m.client = ec2metadata.New(sess)
-			m.document, _ = m.client.GetInstanceIdentityDocument()
-			if m.client.Available() {
+// init waits up to 30 seconds for the metadata service, less if ctx is
+// cancelled first
+func (m *InstanceMetadata) init(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	sess, err := session.NewSession()
+	if err != nil {
+		return err
+	}
+	m.client = ec2metadata.New(sess)
+	for i := 1; ; i++ {
+		log.Printf("[INFO] Connecting metadata service (%d)", i)
+		if m.client.AvailableWithContext(ctx) {
+			if m.document, err = m.client.GetInstanceIdentityDocumentWithContext(ctx); err == nil {
 				log.Printf("[INFO] AWS EC2 instance detected via default metadata API endpoint")
-				return m.client
+				return nil
 			}
-		case <-timeout:
-			panic("AWS metadata service connection failed")
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("AWS metadata service connection failed %s", ctx.Err())
+		case <-time.After(time.Second):
 		}
 	}
 }
 
-func (executable AWSECS) execute(handler MessageHandler) {
-	handler.initialize()
-	if handler.receive() {
-		executable.executableTimeoutHelper(handler)
+// locate finds the cluster, container instance and region to start tasks
+// in. Only the first call asks the metadata services.
+func (executable *AWSECS) locate(ctx context.Context) (*ecsPlacement, error) {
+	instance := executable.instance
+	instance.mu.Lock()
+	defer instance.mu.Unlock()
+	if instance.placement != nil {
+		return instance.placement, nil
+	}
+	m := &InstanceMetadata{}
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+	e := &ECSMetadata{}
+	if err := e.init(ctx); err != nil {
+		return nil, err
 	}
+	instance.placement = &ecsPlacement{
+		cluster:           e.Cluster,
+		containerInstance: e.ContainerInstanceArn,
+		region:            m.document.Region,
+	}
+	return instance.placement, nil
 }
 
-func (executable *AWSECS) executableTimeoutHelper(handler MessageHandler) {
-	// Channel receives exit event
-	ch := make(chan error)
-	go func() {
-		ch <- executable.executionHelper(handler.body(), handler.id())
-	}()
-	select {
-	case err := <-ch:
-		if err != nil {
-			log.Printf("E: %s %s", *executable.ecsTaskDefinition, err.Error())
-			if strings.Contains(err.Error(), "InvalidParameterException") {
-				executable.result.SetExit("PARAMETER")
-			} else if executable.result.Exit == "" {
-				executable.result.SetExit("UNKNOWN")
-			}
-			handler.failure(executable.result)
-		} else {
-			log.Printf("I: %s finished successfully", *executable.ecsTaskDefinition)
-			handler.success()
-		}
-	case <-time.After(executable.timeout):
-		err := fmt.Errorf("%s timed out after %f seconds", *executable.ecsTaskDefinition, executable.timeout.Seconds())
-		log.Println(err)
-		executable.result.SetExit("TIMEOUT")
-		handler.failure(executable.result)
+// located is the placement locate found, nil before it found one
+func (executable *AWSECS) located() *ecsPlacement {
+	executable.instance.mu.Lock()
+	defer executable.instance.mu.Unlock()
+	return executable.instance.placement
+}
+
+func (executable *AWSECS) executableTimeoutHelper(ctx context.Context, handler MessageHandler) {
+	run := func(ctx context.Context, started chan<- stopper) error {
+		return executable.executionHelper(ctx, handler.body(), handler.id(), started)
 	}
+	runTask(ctx, handler, *executable.ecsTaskDefinition, executable.timeout, &executable.result, run, func(err error) {
+		if err == nil {
+			return
+		}
+		if strings.Contains(err.Error(), "InvalidParameterException") {
+			executable.result.SetExit("PARAMETER")
+		} else if executable.result.Exit == "" {
+			executable.result.SetExit("UNKNOWN")
+		}
+	})
 }
 
-func (executable *AWSECS) executionHelper(messageBody *string, messageID *string) error {
+func (executable *AWSECS) executionHelper(ctx context.Context, messageBody *string, messageID *string, started chan<- stopper) error {
 	var err error
 	var taskArn string
-	taskArn, err = executable.startECSContainer(messageBody, messageID)
+	taskArn, err = executable.startECSContainer(ctx, messageBody, messageID)
 	executable.taskArn = taskArn
+	if executable.payloadFile != "" {
+		defer os.Remove(executable.payloadFile)
+	}
+	if executable.attributesFile != "" {
+		defer os.Remove(executable.attributesFile)
+	}
+	if executable.outputFile != "" {
+		defer os.Remove(executable.outputFile)
+	}
 	if err != nil {
 		return err
 	}
-	err = executable.monitorDocker()
+	executable.running.mu.Lock()
+	executable.running.taskArn = taskArn
+	executable.running.mu.Unlock()
+	defer func() {
+		executable.running.mu.Lock()
+		executable.running.taskArn = ""
+		executable.running.mu.Unlock()
+	}()
+	started <- func(exited <-chan struct{}) {
+		executable.stopECSTask(context.Background(), taskArn)
+	}
+	err = executable.monitorDocker(ctx)
 	if err != nil {
 		return err
 	}
@@ -166,48 +266,81 @@ func (executable *AWSECS) executionHelper(messageBody *string, messageID *string
 //  Task ARN is part of Docker labels...
 //                 "com.amazonaws.ecs.task-arn": "arn:aws:ecs:us-west-2:770136283015:task/d8e65fde-65dc-4e46-aeaa-8b2b33215349",
 
-func (executable *AWSECS) startECSContainer(messageBody *string, messageID *string) (string, error) {
-	e := &ECSMetadata{}
-	m := &InstanceMetadata{}
-	m.init()
-	e.init()
-	var ecsCluster *string
-	var containerInstanceID *string
+func (executable *AWSECS) startECSContainer(ctx context.Context, messageBody *string, messageID *string) (string, error) {
+	placement, err := executable.locate(ctx)
+	if err != nil {
+		return "", err
+	}
 
-	ecsCluster = aws.String(e.Cluster)
-	containerInstanceID = aws.String(e.ContainerInstanceArn)
+	var environment []*ecs.KeyValuePair
+	if executable.payload.env {
+		environment = append(environment, &ecs.KeyValuePair{
+			Name:  executable.overridePayloadKey,
+			Value: aws.String(*messageBody),
+		})
+	}
+	if executable.payload.file {
+		// payloadDir has to be a volume shared with the task at the same path
+		payloadFile, err := writePayloadFile(executable.payloadDir, messageBody)
+		if err != nil {
+			return "", err
+		}
+		environment = append(environment, &ecs.KeyValuePair{
+			Name:  aws.String("TASK_PAYLOAD_FILE"),
+			Value: aws.String(payloadFile),
+		})
+		executable.payloadFile = payloadFile
+		attributesFile, err := writeAttributesFile(executable.payloadDir, executable.handler.attributes())
+		if err != nil {
+			return "", err
+		}
+		environment = append(environment, &ecs.KeyValuePair{
+			Name:  aws.String("TASK_ATTRIBUTES_FILE"),
+			Value: aws.String(attributesFile),
+		})
+		executable.attributesFile = attributesFile
+	}
+	for _, env := range attributeEnv(executable.payload, executable.handler.attributes()) {
+		parts := strings.SplitN(env, "=", 2)
+		environment = append(environment, &ecs.KeyValuePair{
+			Name:  aws.String(parts[0]),
+			Value: aws.String(parts[1]),
+		})
+	}
+	outputFile, err := createOutputFile(executable.payloadDir)
+	if err != nil {
+		return "", err
+	}
+	environment = append(environment, &ecs.KeyValuePair{
+		Name:  aws.String("TASK_OUTPUT_FILE"),
+		Value: aws.String(outputFile),
+	})
+	executable.outputFile = outputFile
 
 	// Start ECS task on self
-	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-west-2")})
+	svc, err := executable.ecsClient(placement.region)
 	if err != nil {
-		fmt.Println("failed to create session,", err)
+		log.Printf("E: failed to create session %s", err)
 		return "", err
 	}
 
-	svc := ecs.New(sess)
-
 	params := &ecs.StartTaskInput{
 		ContainerInstances: []*string{
-			containerInstanceID,
+			aws.String(placement.containerInstance),
 		},
 		TaskDefinition: executable.ecsTaskDefinition,
-		Cluster:        ecsCluster,
+		Cluster:        aws.String(placement.cluster),
 		Overrides: &ecs.TaskOverride{
 			ContainerOverrides: []*ecs.ContainerOverride{
 				{
-					Environment: []*ecs.KeyValuePair{
-						{
-							Name:  executable.overridePayloadKey,
-							Value: aws.String(*messageBody),
-						},
-					},
-					Name: executable.overrideContainerName,
+					Environment: environment,
+					Name:        executable.overrideContainerName,
 				},
 			},
 		},
 		StartedBy: aws.String("tasque"),
 	}
-	resp, err := svc.StartTask(params)
+	resp, err := svc.StartTaskWithContext(ctx, params)
 
 	if err != nil {
 		// Print the error, cast err to awserr.Error to get the Code and
@@ -248,14 +381,51 @@ func (executable *AWSECS) startECSContainer(messageBody *string, messageID *stri
 	return *taskArn, nil
 }
 
-func (executable *AWSECS) monitorDocker() error {
+// ecsClient uses the instance's region unless one is configured
+func (executable *AWSECS) ecsClient(instanceRegion string) (*ecs.ECS, error) {
+	sess, err := executable.aws.session()
+	if err != nil {
+		return nil, err
+	}
+	return ecs.New(sess, executable.aws.clientConfig(executable.aws.ECSEndpoint, instanceRegion)), nil
+}
+
+// stopECSTask stops a task startECSContainer started, in the placement it
+// already looked up
+func (executable *AWSECS) stopECSTask(ctx context.Context, taskArn string) {
+	placement := executable.located()
+	if placement == nil {
+		log.Printf("Couldn't stop task %s, its cluster is unknown", taskArn)
+		return
+	}
+	svc, err := executable.ecsClient(placement.region)
+	if err != nil {
+		log.Printf("Couldn't stop task %s, failed to create session %s", taskArn, err)
+		return
+	}
+
+	params := &ecs.StopTaskInput{
+		Cluster: aws.String(placement.cluster),
+		Task:    aws.String(taskArn),
+		Reason:  aws.String("tasque shutdown"),
+	}
+	if _, err := svc.StopTaskWithContext(ctx, params); err != nil {
+		log.Printf("Stop task %s (%s)", taskArn, err)
+	} else {
+		log.Printf("Stopped task %s", taskArn)
+	}
+}
+
+func (executable *AWSECS) monitorDocker(ctx context.Context) error {
 	executable.docker.addListener()
 	// Monitor docker events for sibling Projector task
-	status, err := executable.listenForDie()
+	status, err := executable.listenForDie(ctx)
 	if err != nil {
 		return err
 	}
 	executable.result.SetExit(status)
+	// Only shows up when payloadDir is a volume shared with the task
+	executable.result.Output = readOutputFile(executable.outputFile)
 
 	if status == "0" {
 		// status is die
@@ -271,16 +441,10 @@ func (executable *AWSECS) monitorDocker() error {
 
 }
 
-func (executable *AWSECS) listenForDie() (exitCode string, err error) {
+func (executable *AWSECS) listenForDie(ctx context.Context) (exitCode string, err error) {
 	log.Printf("[INFO] Monitoring Docker events.")
 	log.Printf("[DEBUG] %+v\n", executable.docker)
-	duration := getTimeout()
-	timeout := time.After(duration)
-	ticker := time.NewTicker(getHeartbeatTime())
-	defer func() {
-		executable.docker.removeListener()
-		ticker.Stop()
-	}()
+	defer executable.docker.removeListener()
 	for {
 		select {
 		case msg := <-executable.docker.eventsCh:
@@ -295,27 +459,12 @@ func (executable *AWSECS) listenForDie() (exitCode string, err error) {
 					case "start":
 						log.Printf("[INFO] Container start event")
 						executable.result.SetHost(msg.ID[0:12])
-						// Ticker to check docker container status
-						go func() {
-							for t := range ticker.C {
-								container, err := executable.docker.client.InspectContainer(msg.ID)
-								if err != nil {
-									log.Println(fmt.Errorf("There was an error checking container status %s", err.Error()))
-								}
-								if container.State.Running == true {
-									executable.handler.heartbeat()
-									log.Println("Heartbeat", t)
-								} else {
-									log.Printf("Container state is %s", container.State.Status)
-								}
-							}
-						}()
 					}
 				}
 			}
-		case <-timeout:
+		case <-ctx.Done():
 			log.Printf("[INFO] Instance timeout reached.")
-			err := fmt.Errorf("Docker container %s timed out after %f seconds", *executable.ecsTaskDefinition, duration.Seconds())
+			err := fmt.Errorf("Docker container %s timed out after %f seconds", *executable.ecsTaskDefinition, executable.timeout.Seconds())
 			return "timeout", err
 		}
 	}
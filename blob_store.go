@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// payloadPointerClasses are the pointer types written by the SQS Extended
+// Client libraries, the first one by the older Java client
+var payloadPointerClasses = []string{
+	"com.amazon.sqs.javamessaging.MessageS3Pointer",
+	"software.amazon.payloadoffloading.PayloadS3Pointer",
+}
+
+// payloadPointer is where a message's real payload is stored
+type payloadPointer struct {
+	Bucket string `json:"s3BucketName"`
+	Key    string `json:"s3Key"`
+}
+
+// BlobStore fetches payloads that messages only point to
+type BlobStore interface {
+	get(ctx context.Context, bucket string, key string) ([]byte, error)
+}
+
+// LocalBlobStore keeps each bucket in a directory of its own under dir
+type LocalBlobStore struct {
+	dir string
+}
+
+// S3BlobStore fetches from S3 or anything that speaks its API
+type S3BlobStore struct {
+	client s3iface.S3API
+}
+
+// newBlobStore builds the store named by TASK_BLOB_STORE, s3 or local
+func newBlobStore(store string, dir string, awsConfig *AWSConfig) (BlobStore, error) {
+	switch store {
+	case "s3", "":
+		return newS3BlobStore(awsConfig)
+	case "local":
+		if dir == "" {
+			return nil, fmt.Errorf("The local blob store needs a directory")
+		}
+		return &LocalBlobStore{dir: dir}, nil
+	}
+	return nil, fmt.Errorf("Unknown blob store %q, expecting s3 or local", store)
+}
+
+func newS3BlobStore(awsConfig *AWSConfig) (*S3BlobStore, error) {
+	sess, err := awsConfig.session()
+	if err != nil {
+		return nil, err
+	}
+	config := awsConfig.clientConfig(awsConfig.S3Endpoint, "")
+	if awsConfig.S3Endpoint != "" {
+		// S3 compatible stores rarely support virtual hosted buckets
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	return &S3BlobStore{client: s3.New(sess, config)}, nil
+}
+
+func (store *LocalBlobStore) get(ctx context.Context, bucket string, key string) ([]byte, error) {
+	root := filepath.Clean(store.dir)
+	path := filepath.Join(root, bucket, key)
+	if !strings.HasPrefix(path, root+string(filepath.Separator)) {
+		return nil, fmt.Errorf("%s/%s is outside of %s", bucket, key, root)
+	}
+	return ioutil.ReadFile(path)
+}
+
+func (store *S3BlobStore) get(ctx context.Context, bucket string, key string) ([]byte, error) {
+	getObjectParams := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	getObjectResponse, getObjectError := store.client.GetObjectWithContext(ctx, getObjectParams)
+	if getObjectError != nil {
+		return nil, getObjectError
+	}
+	defer getObjectResponse.Body.Close()
+	return ioutil.ReadAll(getObjectResponse.Body)
+}
+
+// parsePayloadPointer recognises a body of the form
+// ["software.amazon.payloadoffloading.PayloadS3Pointer", {"s3BucketName": "...", "s3Key": "..."}]
+func parsePayloadPointer(body string) (*payloadPointer, bool) {
+	if !strings.HasPrefix(strings.TrimSpace(body), "[") {
+		return nil, false
+	}
+	var parts []json.RawMessage
+	if err := json.Unmarshal([]byte(body), &parts); err != nil || len(parts) != 2 {
+		return nil, false
+	}
+	var class string
+	if err := json.Unmarshal(parts[0], &class); err != nil || !stringInSlice(class, payloadPointerClasses) {
+		return nil, false
+	}
+	pointer := &payloadPointer{}
+	if err := json.Unmarshal(parts[1], pointer); err != nil || pointer.Bucket == "" || pointer.Key == "" {
+		return nil, false
+	}
+	return pointer, true
+}
+
+// resolvePayload returns the payload a pointer body points to, or the body
+// itself
+func resolvePayload(ctx context.Context, store BlobStore, body string) (string, error) {
+	pointer, ok := parsePayloadPointer(body)
+	if !ok {
+		return body, nil
+	}
+	if store == nil {
+		return "", fmt.Errorf("No blob store for payload s3://%s/%s", pointer.Bucket, pointer.Key)
+	}
+	payload, err := store.get(ctx, pointer.Bucket, pointer.Key)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't fetch payload s3://%s/%s %s", pointer.Bucket, pointer.Key, err)
+	}
+	return string(payload), nil
+}
+
+// resolvedMessage hands the executable the payload a pointer message points
+// to. The message itself keeps the pointer, e.g. as the Step Functions
+// output when the task writes none, or for the quarantine.
+type resolvedMessage struct {
+	MessageHandler
+	payload string
+}
+
+func (message *resolvedMessage) body() *string {
+	return &message.payload
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestParsePayloadPointer(t *testing.T) {
+	tests := []struct {
+		body   string
+		bucket string
+		key    string
+	}{
+		{`["software.amazon.payloadoffloading.PayloadS3Pointer", {"s3BucketName": "payloads", "s3Key": "a/b.json"}]`, "payloads", "a/b.json"},
+		{` ["com.amazon.sqs.javamessaging.MessageS3Pointer",{"s3BucketName":"payloads","s3Key":"c"}]`, "payloads", "c"},
+		{`{"s3BucketName": "payloads", "s3Key": "a/b.json"}`, "", ""},
+		{`["some.other.Class", {"s3BucketName": "payloads", "s3Key": "a/b.json"}]`, "", ""},
+		{`["software.amazon.payloadoffloading.PayloadS3Pointer", {"s3BucketName": "payloads"}]`, "", ""},
+		{`["software.amazon.payloadoffloading.PayloadS3Pointer", {"s3BucketName": "payloads", "s3Key": "a"}, 3]`, "", ""},
+		{`["software.amazon.payloadoffloading.PayloadS3Pointer"`, "", ""},
+		{`[1, 2]`, "", ""},
+		{`plain text`, "", ""},
+	}
+	for _, test := range tests {
+		pointer, ok := parsePayloadPointer(test.body)
+		if test.bucket == "" {
+			if ok {
+				t.Errorf("%s: got pointer %+v, want none", test.body, pointer)
+			}
+			continue
+		}
+		if !ok || pointer.Bucket != test.bucket || pointer.Key != test.key {
+			t.Errorf("%s: got %+v %v, want s3://%s/%s", test.body, pointer, ok, test.bucket, test.key)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/blaines/tasque-go/result"
+)
+
+// callbackMessage is an SQS message sent by a waitForTaskToken state. Its
+// result goes to Step Functions, which does the retrying, so the message is
+// deleted whether the task succeeds or fails, as long as the result got
+// there.
+type callbackMessage struct {
+	*SQSMessage
+	task *SFNHandler
+}
+
+// newCallbackMessage finds the task token at the handler's TASK_TOKEN_PATH
+func (handler *SQSHandler) newCallbackMessage(message *SQSMessage) (*callbackMessage, error) {
+	token, err := jsonPathString(message.messageBody, handler.taskTokenPath)
+	if err != nil {
+		return nil, fmt.Errorf("has no task token at %s %s", handler.taskTokenPath, err)
+	}
+	return &callbackMessage{
+		SQSMessage: message,
+		task: &SFNHandler{
+			client:      *handler.sfnClient,
+			taskToken:   token,
+			messageBody: message.messageBody,
+		},
+	}, nil
+}
+
+func (message *callbackMessage) success(ctx context.Context, r result.Result) {
+	message.settle(ctx, message.task.sendSuccess(ctx, r))
+}
+
+func (message *callbackMessage) failure(ctx context.Context, err result.Result) {
+	message.settle(ctx, message.task.sendFailure(ctx, err.Error, err.Cause(sfnMaxCause)))
+}
+
+func (message *callbackMessage) discard(ctx context.Context, err result.Result) {
+	message.settle(ctx, message.task.sendFailure(ctx, "Quarantined", err.Cause(sfnMaxCause)))
+}
+
+// settle deletes the message once Step Functions has the result, or won't
+// take one any more. Otherwise the message comes back and runs again.
+func (message *callbackMessage) settle(ctx context.Context, err error) {
+	if err != nil && err != errAbandoned {
+		log.Printf("E: Couldn't report %s to Step Functions, leaving it to be redelivered %s", *message.id(), err)
+		return
+	}
+	message.delete(ctx)
+}
+
+// heartbeat keeps both the task token and the message alive
+func (message *callbackMessage) heartbeat(ctx context.Context) error {
+	if err := message.task.heartbeat(ctx); err != nil {
+		return err
+	}
+	return message.SQSMessage.heartbeat(ctx)
+}
+
+// release hands the message to another worker, unless its task token is no
+// longer good for anything
+func (message *callbackMessage) release(ctx context.Context) {
+	if message.task.isAbandoned() {
+		message.delete(ctx)
+		return
+	}
+	message.SQSMessage.release(ctx)
+}
+
+// jsonPathString finds the string at a path like $.TaskToken or
+// $.detail.tokens.0 in a JSON document
+func jsonPathString(document string, path string) (string, error) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(document), &value); err != nil {
+		return "", err
+	}
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value = v[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return "", fmt.Errorf("no element %q", key)
+			}
+			value = v[i]
+		default:
+			return "", fmt.Errorf("no field %q", key)
+		}
+	}
+	s, ok := value.(string)
+	if !ok || s == "" {
+		return "", fmt.Errorf("not a string")
+	}
+	return s, nil
+}
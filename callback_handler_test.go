@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestJSONPathString(t *testing.T) {
+	const document = `{"TaskToken": "token", "detail": {"tokens": ["first", "second"], "count": 2, "empty": ""}}`
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"$.TaskToken", "token"},
+		{"TaskToken", "token"},
+		{"$.detail.tokens.1", "second"},
+		{"$.detail.tokens.2", ""},
+		{"$.detail.tokens.-1", ""},
+		{"$.detail.tokens.first", ""},
+		{"$.detail.count", ""},
+		{"$.detail.empty", ""},
+		{"$.detail", ""},
+		{"$.missing", ""},
+		{"$.TaskToken.deeper", ""},
+	}
+	for _, test := range tests {
+		got, err := jsonPathString(document, test.path)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%s: got %q, want an error", test.path, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%s: got %q %v, want %q", test.path, got, err, test.want)
+		}
+	}
+	if _, err := jsonPathString("not json", "$.TaskToken"); err == nil {
+		t.Error("found a token in a body that isn't JSON")
+	}
+}
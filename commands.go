@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Version is set at build time with -ldflags "-X main.Version=..."
+var Version = "dev"
+
+// Defaults of the settings that validate checks against each other
+const (
+	defaultHeartbeat     = 30 * time.Second
+	defaultRetryDelay    = 30 * time.Second
+	defaultRetryMaxDelay = 15 * time.Minute
+)
+
+// taskFlags are shared by every command that runs tasks
+type taskFlags struct {
+	config      string
+	source      string
+	payload     string
+	queueURL    string
+	resultQueue string
+	activityARN string
+	activities  string
+	// Durations and numbers are strings, which validate parses, so that a
+	// malformed environment variable doesn't get in the way of --help
+	timeout     string
+	heartbeat   string
+	drain       string
+	visibility  string
+	retryDelay  string
+	maxRetry    string
+	daemon      bool
+	concurrency string
+	batchSize   string
+	payloadMode string
+	payloadDir  string
+	blobStore   string
+	blobDir     string
+	aws         AWSConfig
+	snsCert     string
+	maxAttempts string
+	quarantine  string
+	tokenPath   string
+	// problems with the environment variables, reported by validate
+	problems []string
+}
+
+func (f *taskFlags) register(flags *flag.FlagSet) {
+	f.problems = nil
+	flags.StringVar(&f.config, "config", os.Getenv("TASK_CONFIG"), "YAML or JSON configuration file, environment variables override it (TASK_CONFIG)")
+	flags.StringVar(&f.source, "source", os.Getenv("TASK_SOURCE"), "Message source: sqs, sfn or env (TASK_SOURCE, guessed from the settings below when empty)")
+	flags.StringVar(&f.payload, "payload", os.Getenv("TASK_PAYLOAD"), "Payload for the env source (TASK_PAYLOAD)")
+	flags.StringVar(&f.queueURL, "queue-url", os.Getenv("TASK_QUEUE_URL"), "SQS queue URL for the sqs source (TASK_QUEUE_URL)")
+	flags.StringVar(&f.resultQueue, "result-queue-url", os.Getenv("TASK_RESULT_QUEUE_URL"), "SQS queue that gets every SQS message's result, a ReplyTo message attribute overrides it (TASK_RESULT_QUEUE_URL)")
+	flags.StringVar(&f.tokenPath, "task-token-path", os.Getenv("TASK_TOKEN_PATH"), "JSON path of the Step Functions task token in SQS messages sent by waitForTaskToken, e.g. $.TaskToken, the result then goes to Step Functions (TASK_TOKEN_PATH)")
+	flags.StringVar(&f.activityARN, "activity-arn", os.Getenv("TASK_ACTIVITY_ARN"), "Step Functions activity ARN for the sfn source (TASK_ACTIVITY_ARN)")
+	flags.StringVar(&f.activities, "activities", os.Getenv("TASK_ACTIVITIES"), "JSON list of Step Functions activities for a daemon to serve at once, each with an activity_arn and optionally its concurrency, timeout and executable settings (TASK_ACTIVITIES)")
+	flags.StringVar(&f.timeout, "timeout", envString("TASK_TIMEOUT", "30s"), "Task timeout (TASK_TIMEOUT)")
+	flags.StringVar(&f.heartbeat, "heartbeat", envString("TASK_HEARTBEAT", defaultHeartbeat.String()), "Heartbeat interval (TASK_HEARTBEAT)")
+	flags.StringVar(&f.visibility, "visibility-timeout", os.Getenv("TASK_VISIBILITY_TIMEOUT"), "How far each heartbeat extends an SQS message's visibility, twice the heartbeat when empty or 0 (TASK_VISIBILITY_TIMEOUT)")
+	flags.StringVar(&f.retryDelay, "retry-delay", envString("TASK_RETRY_DELAY", defaultRetryDelay.String()), "Delay before a failed SQS message is retried, doubled for every receive, 0 retries immediately (TASK_RETRY_DELAY)")
+	flags.StringVar(&f.maxRetry, "retry-max-delay", envString("TASK_RETRY_MAX_DELAY", defaultRetryMaxDelay.String()), "Longest retry delay (TASK_RETRY_MAX_DELAY)")
+	flags.StringVar(&f.drain, "drain-timeout", envString("TASK_DRAIN_TIMEOUT", "20s"), "Time in-flight tasks get after SIGTERM/SIGINT (TASK_DRAIN_TIMEOUT)")
+	flags.BoolVar(&f.daemon, "daemon", f.envBool("TASK_DAEMON"), "Keep receiving messages instead of exiting after one (TASK_DAEMON)")
+	flags.StringVar(&f.concurrency, "concurrency", envString("TASK_CONCURRENCY", "1"), "Number of tasks a daemon runs at once (TASK_CONCURRENCY)")
+	flags.StringVar(&f.batchSize, "batch-size", envString("TASK_BATCH_SIZE", strconv.Itoa(sqsMaxBatch)), "Most SQS messages received at once, up to 10 (TASK_BATCH_SIZE)")
+	flags.StringVar(&f.payloadMode, "payload-mode", envString("TASK_PAYLOAD_MODE", "all"), "How the task receives the payload: env, stdin, file or all (TASK_PAYLOAD_MODE)")
+	flags.StringVar(&f.payloadDir, "payload-dir", envString("TASK_PAYLOAD_DIR", os.TempDir()), "Directory for payload files (TASK_PAYLOAD_DIR)")
+	flags.StringVar(&f.snsCert, "sns-certificate", os.Getenv("TASK_SNS_CERTIFICATE"), "PEM certificate that SNS notifications have to be signed with, unchecked when empty (TASK_SNS_CERTIFICATE)")
+	flags.StringVar(&f.maxAttempts, "max-attempts", envString("TASK_MAX_ATTEMPTS", "0"), "Failures after which an SQS message is quarantined, 0 for no limit (TASK_MAX_ATTEMPTS)")
+	flags.StringVar(&f.quarantine, "quarantine", os.Getenv("TASK_QUARANTINE"), "Where quarantined messages go: an SQS queue URL, a directory, or sfn for only a permanent failure of their task token (TASK_QUARANTINE)")
+	flags.StringVar(&f.blobStore, "blob-store", envString("TASK_BLOB_STORE", "s3"), "Where pointer messages' payloads are fetched from: s3 or local (TASK_BLOB_STORE)")
+	flags.StringVar(&f.blobDir, "blob-dir", os.Getenv("TASK_BLOB_DIR"), "Directory of the local blob store, one subdirectory per bucket (TASK_BLOB_DIR)")
+	flags.StringVar(&f.aws.Region, "region", os.Getenv("AWS_REGION"), "AWS region, the activity's or the instance's own when empty (AWS_REGION)")
+	flags.StringVar(&f.aws.Profile, "profile", os.Getenv("AWS_PROFILE"), "AWS shared config profile (AWS_PROFILE)")
+	// Not AWS_ROLE_ARN, the SDK uses that for web identity credentials
+	flags.StringVar(&f.aws.RoleARN, "role-arn", os.Getenv("TASK_ROLE_ARN"), "IAM role to assume for every AWS client (TASK_ROLE_ARN)")
+	flags.StringVar(&f.aws.ExternalID, "external-id", os.Getenv("TASK_EXTERNAL_ID"), "External ID for assuming --role-arn (TASK_EXTERNAL_ID)")
+	flags.StringVar(&f.aws.SQSEndpoint, "sqs-endpoint", os.Getenv("AWS_SQS_ENDPOINT"), "SQS endpoint, e.g. ElasticMQ (AWS_SQS_ENDPOINT)")
+	flags.StringVar(&f.aws.SFNEndpoint, "sfn-endpoint", os.Getenv("AWS_SFN_ENDPOINT"), "Step Functions endpoint, e.g. Step Functions Local (AWS_SFN_ENDPOINT)")
+	flags.StringVar(&f.aws.ECSEndpoint, "ecs-endpoint", os.Getenv("AWS_ECS_ENDPOINT"), "ECS endpoint (AWS_ECS_ENDPOINT)")
+	flags.StringVar(&f.aws.S3Endpoint, "s3-endpoint", os.Getenv("AWS_S3_ENDPOINT"), "Endpoint of an S3 compatible blob store (AWS_S3_ENDPOINT)")
+}
+
+// settings are the flags as a Config, for validate. Commands add their own.
+func (f *taskFlags) settings() *Config {
+	config := &Config{
+		Source:               f.source,
+		QueueURL:             f.queueURL,
+		TaskTokenPath:        f.tokenPath,
+		ResultQueueURL:       f.resultQueue,
+		ActivityARN:          f.activityARN,
+		Timeout:              f.timeout,
+		Heartbeat:            f.heartbeat,
+		DrainTimeout:         f.drain,
+		VisibilityTimeout:    f.visibility,
+		RetryDelay:           f.retryDelay,
+		RetryMaxDelay:        f.maxRetry,
+		PayloadMode:          f.payloadMode,
+		PayloadDir:           f.payloadDir,
+		BlobStore:            f.blobStore,
+		BlobDir:              f.blobDir,
+		SNSCertificate:       f.snsCert,
+		Quarantine:           f.quarantine,
+		Daemon:               f.daemon,
+		ErrorMessageTemplate: os.Getenv("ERROR_MESSAGE_TEMPLATE"),
+		AWS: AWSSettings{
+			Region:      f.aws.Region,
+			Profile:     f.aws.Profile,
+			RoleARN:     f.aws.RoleARN,
+			ExternalID:  f.aws.ExternalID,
+			SQSEndpoint: f.aws.SQSEndpoint,
+			SFNEndpoint: f.aws.SFNEndpoint,
+			ECSEndpoint: f.aws.ECSEndpoint,
+			S3Endpoint:  f.aws.S3Endpoint,
+		},
+		payload:  f.payload,
+		problems: append([]string{}, f.problems...),
+	}
+	number := func(name string, value string) *int {
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			config.problems = append(config.problems, fmt.Sprintf("%s %q is not a number", name, value))
+			return nil
+		}
+		return &i
+	}
+	config.Concurrency = number("concurrency (TASK_CONCURRENCY)", f.concurrency)
+	config.BatchSize = number("batch_size (TASK_BATCH_SIZE)", f.batchSize)
+	if maxAttempts := number("max_attempts (TASK_MAX_ATTEMPTS)", f.maxAttempts); maxAttempts != nil {
+		config.MaxAttempts = *maxAttempts
+	}
+	if f.activities != "" {
+		config.parseActivities(f.activities)
+	}
+	config.overlayRetryEnv()
+	return config
+}
+
+// activityExecutable builds the executable of one of several activities,
+// timeout is the activity's own or else --timeout
+type activityExecutable func(activity ActivityConfig, timeout time.Duration) (ExecutableInterface, error)
+
+// tasque validates the command's settings, see Config.validate, and builds a
+// Tasque around the executable
+func (f *taskFlags) tasque(config *Config, command string, executable ExecutableInterface, activityExecutable activityExecutable) (*Tasque, error) {
+	if problems := config.validate(command); len(problems) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	// validate has checked these
+	heartbeat := durationOr(f.heartbeat, 0)
+	visibility := durationOr(f.visibility, 0)
+	if visibility == 0 {
+		visibility = 2 * heartbeat
+	}
+	activities, err := f.buildActivities(config, activityExecutable)
+	if err != nil {
+		return nil, err
+	}
+	quarantine, err := newQuarantine(f.quarantine, &f.aws)
+	if err != nil {
+		return nil, err
+	}
+	blobStore, err := newBlobStore(f.blobStore, f.blobDir, &f.aws)
+	if err != nil {
+		return nil, err
+	}
+	var snsCertificate *x509.Certificate
+	if f.snsCert != "" {
+		if snsCertificate, err = loadSNSCertificate(f.snsCert); err != nil {
+			return nil, err
+		}
+	}
+	return &Tasque{
+		Source:         config.messageSource(),
+		Payload:        f.payload,
+		QueueURL:       f.queueURL,
+		ActivityARN:    f.activityARN,
+		Executable:     executable,
+		Daemon:         f.daemon,
+		Concurrency:    *config.Concurrency,
+		DrainTimeout:   durationOr(f.drain, 0),
+		Heartbeat:      heartbeat,
+		Visibility:     visibility,
+		RetryDelay:     durationOr(f.retryDelay, 0),
+		MaxRetry:       durationOr(f.maxRetry, 0),
+		BatchSize:      *config.BatchSize,
+		ResultQueueURL: f.resultQueue,
+		AWS:            &f.aws,
+		MaxAttempts:    config.MaxAttempts,
+		Quarantine:     quarantine,
+		BlobStore:      blobStore,
+		SNSCertificate: snsCertificate,
+		TaskTokenPath:  f.tokenPath,
+		Activities:     activities,
+	}, nil
+}
+
+// buildActivities builds the validated activities' executables
+func (f *taskFlags) buildActivities(settings *Config, activityExecutable activityExecutable) ([]Activity, error) {
+	var activities []Activity
+	for _, config := range settings.Activities {
+		concurrency := config.Concurrency
+		if concurrency == 0 {
+			concurrency = *settings.Concurrency
+		}
+		timeout := durationOr(settings.Timeout, 0)
+		if config.Timeout != "" {
+			timeout, _ = time.ParseDuration(config.Timeout)
+		}
+		executable, err := activityExecutable(config, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s", config.ActivityARN, err)
+		}
+		activities = append(activities, Activity{
+			ARN:         config.ActivityARN,
+			Concurrency: concurrency,
+			Executable:  executable,
+		})
+	}
+	return activities, nil
+}
+
+// ExecCommand runs a local program for each message
+type ExecCommand struct {
+	taskFlags
+	killGrace string
+}
+
+func (c *ExecCommand) flags() *flag.FlagSet {
+	flags := flag.NewFlagSet("exec", flag.ContinueOnError)
+	c.register(flags)
+	flags.StringVar(&c.killGrace, "kill-grace", envString("TASK_KILL_GRACE", "10s"), "Time between SIGTERM and SIGKILL for a timed out task (TASK_KILL_GRACE)")
+	return flags
+}
+
+func (c *ExecCommand) Help() string {
+	return usage("tasque exec [options] -- command [args...]", "Run a command for each message.", c.flags())
+}
+
+func (c *ExecCommand) Synopsis() string {
+	return "Run a command for each message"
+}
+
+func (c *ExecCommand) Run(args []string) int {
+	flags, err := parseFlags(c.flags, args)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	arguments := flags.Args()
+	if len(arguments) == 0 && c.activities == "" {
+		log.Println("Expecting tasque to be run with an application")
+		log.Println("Usage: tasque exec -- npm start")
+		return 1
+	}
+	// A bad payload mode or duration is reported by tasque with everything
+	// else
+	payload, _ := parsePayloadMode(c.payloadMode)
+	executable := &Executable{
+		timeout:    durationOr(c.timeout, 0),
+		killGrace:  durationOr(c.killGrace, 0),
+		payload:    payload,
+		payloadDir: c.payloadDir,
+	}
+	if len(arguments) > 0 {
+		executable.binary = arguments[0]
+		executable.arguments = arguments[1:]
+	}
+	config := c.settings()
+	config.KillGrace = c.killGrace
+	tasque, err := c.tasque(config, "exec", executable, func(activity ActivityConfig, timeout time.Duration) (ExecutableInterface, error) {
+		e := *executable
+		e.timeout = timeout
+		if len(activity.Command) > 0 {
+			e.binary = activity.Command[0]
+			e.arguments = activity.Command[1:]
+		}
+		if e.binary == "" {
+			return nil, fmt.Errorf("has no command and none was given after --")
+		}
+		return &e, nil
+	})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	tasque.runWithTimeout()
+	return 0
+}
+
+// DockerCommand runs a sibling Docker container for each message
+type DockerCommand struct {
+	taskFlags
+	containerName  string
+	taskDefinition string
+	endpoint       string
+}
+
+func (c *DockerCommand) flags() *flag.FlagSet {
+	flags := flag.NewFlagSet("docker", flag.ContinueOnError)
+	c.register(flags)
+	flags.StringVar(&c.containerName, "container-name", os.Getenv("DOCKER_CONTAINER_NAME"), "Name of the task container (DOCKER_CONTAINER_NAME)")
+	flags.StringVar(&c.taskDefinition, "task-definition", os.Getenv("DOCKER_TASK_DEFINITION"), "JSON task definition with ImageName, MacAddress and Env (DOCKER_TASK_DEFINITION)")
+	flags.StringVar(&c.endpoint, "endpoint", envString("DOCKER_ENDPOINT", "unix:///var/run/docker.sock"), "Docker API endpoint (DOCKER_ENDPOINT)")
+	return flags
+}
+
+func (c *DockerCommand) Help() string {
+	return usage("tasque docker [options]", "Run a Docker container for each message.", c.flags())
+}
+
+func (c *DockerCommand) Synopsis() string {
+	return "Run a Docker container for each message"
+}
+
+func (c *DockerCommand) Run(args []string) int {
+	if _, err := parseFlags(c.flags, args); err != nil {
+		log.Println(err)
+		return 1
+	}
+	config := c.settings()
+	config.Docker.ContainerName = c.containerName
+	config.Docker.Endpoint = c.endpoint
+	if c.taskDefinition != "" {
+		config.parseDockerTaskDefinition(c.taskDefinition)
+	}
+	// Whatever is wrong with these is reported by tasque
+	payload, _ := parsePayloadMode(c.payloadMode)
+	d := &AWSDOCKER{
+		containerName: c.containerName,
+		timeout:       durationOr(c.timeout, 0),
+		containerArgs: c.payload,
+		payload:       payload,
+	}
+	if config.Docker.TaskDefinition != nil {
+		d.dockerTaskDefinition = *config.Docker.TaskDefinition
+	}
+	d.connect(c.endpoint)
+	tasque, err := c.tasque(config, "docker", d, func(activity ActivityConfig, timeout time.Duration) (ExecutableInterface, error) {
+		e := *d
+		e.timeout = timeout
+		if activity.Image != "" {
+			e.dockerTaskDefinition.ImageName = activity.Image
+		}
+		if activity.ContainerName != "" {
+			e.containerName = activity.ContainerName
+		}
+		return &e, nil
+	})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	tasque.runWithTimeout()
+	return 0
+}
+
+// ECSCommand starts an ECS task on this container instance for each message
+type ECSCommand struct {
+	taskFlags
+	containerName  string
+	taskDefinition string
+	endpoint       string
+}
+
+func (c *ECSCommand) flags() *flag.FlagSet {
+	flags := flag.NewFlagSet("ecs", flag.ContinueOnError)
+	c.register(flags)
+	flags.StringVar(&c.containerName, "container-name", os.Getenv("ECS_CONTAINER_NAME"), "Container in the task definition that receives the payload (ECS_CONTAINER_NAME)")
+	flags.StringVar(&c.taskDefinition, "task-definition", os.Getenv("ECS_TASK_DEFINITION"), "ECS task definition (ECS_TASK_DEFINITION)")
+	flags.StringVar(&c.endpoint, "endpoint", envString("DOCKER_ENDPOINT", "unix:///var/run/docker.sock"), "Docker API endpoint (DOCKER_ENDPOINT)")
+	return flags
+}
+
+func (c *ECSCommand) Help() string {
+	return usage("tasque ecs [options]", "Start an ECS task on this container instance for each message.", c.flags())
+}
+
+func (c *ECSCommand) Synopsis() string {
+	return "Start an ECS task for each message"
+}
+
+func (c *ECSCommand) Run(args []string) int {
+	if _, err := parseFlags(c.flags, args); err != nil {
+		log.Println(err)
+		return 1
+	}
+	config := c.settings()
+	config.ECS.TaskDefinition = c.taskDefinition
+	config.ECS.ContainerName = c.containerName
+	// Whatever is wrong with the mode or timeout is reported by tasque. Container
+	// overrides can't attach to the task's standard input, all leaves it out.
+	payload, _ := parsePayloadMode(c.payloadMode)
+	payload.stdin = false
+	d := &Docker{}
+	executable := &AWSECS{
+		docker:                d,
+		ecsTaskDefinition:     &c.taskDefinition,
+		overrideContainerName: &c.containerName,
+		overridePayloadKey:    aws.String("TASK_PAYLOAD"),
+		timeout:               durationOr(c.timeout, 0),
+		payload:               payload,
+		payloadDir:            c.payloadDir,
+		aws:                   &c.aws,
+		running:               &runningTask{},
+		instance:              &ecsInstance{},
+	}
+	tasque, err := c.tasque(config, "ecs", executable, func(activity ActivityConfig, timeout time.Duration) (ExecutableInterface, error) {
+		e := *executable
+		e.timeout = timeout
+		if activity.TaskDefinition != "" {
+			e.ecsTaskDefinition = aws.String(activity.TaskDefinition)
+		}
+		if activity.ContainerName != "" {
+			e.overrideContainerName = aws.String(activity.ContainerName)
+		}
+		return &e, nil
+	})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	d.connect(c.endpoint)
+	tasque.runWithTimeout()
+	return 0
+}
+
+// VersionCommand prints the version
+type VersionCommand struct{}
+
+func (c *VersionCommand) Help() string {
+	return "Usage: tasque version\n\n  Print the tasque version."
+}
+
+func (c *VersionCommand) Synopsis() string {
+	return "Print the tasque version"
+}
+
+func (c *VersionCommand) Run(args []string) int {
+	fmt.Println(Version)
+	return 0
+}
+
+func usage(synopsis string, description string, flags *flag.FlagSet) string {
+	var options bytes.Buffer
+	flags.SetOutput(&options)
+	flags.PrintDefaults()
+	return strings.TrimSpace(fmt.Sprintf("Usage: %s\n\n  %s\n\nOptions:\n\n%s", synopsis, description, options.String()))
+}
+
+func envString(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// envBool is false unless the environment variable is set, a value that
+// isn't true or false is a problem
+func (f *taskFlags) envBool(key string) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		f.problems = append(f.problems, fmt.Sprintf("%s %q is not true or false", key, value))
+	}
+	return b
+}
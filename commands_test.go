@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDaemonEnv(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    bool
+		problem bool
+	}{
+		{"true", true, false},
+		{"1", true, false},
+		{"false", false, false},
+		{"0", false, false},
+		{"yes", false, true},
+	}
+	for _, test := range tests {
+		t.Setenv("TASK_DAEMON", test.value)
+		c := &ExecCommand{}
+		c.flags()
+		fromFlags := c.settings()
+		fromFile := &Config{}
+		fromFile.overlayEnv()
+		for _, config := range []*Config{fromFlags, fromFile} {
+			problems := strings.Join(config.problems, "; ")
+			if config.Daemon != test.want || strings.Contains(problems, "TASK_DAEMON") != test.problem {
+				t.Errorf("TASK_DAEMON=%s: got %t %q", test.value, config.Daemon, problems)
+			}
+		}
+	}
+}
+
+func TestMalformedEnv(t *testing.T) {
+	t.Setenv("TASK_QUEUE_URL", "https://sqs.us-east-1.amazonaws.com/123456789012/tasks")
+	t.Setenv("TASK_TIMEOUT", "soon")
+	t.Setenv("TASK_KILL_GRACE", "10")
+	t.Setenv("TASK_CONCURRENCY", "many")
+	t.Setenv("TASK_MAX_ATTEMPTS", "3x")
+	c := &ExecCommand{}
+	if help := c.Help(); !strings.Contains(help, "-timeout") {
+		t.Errorf("got help %q", help)
+	}
+
+	if _, err := parseFlags(c.flags, nil); err != nil {
+		t.Fatal(err)
+	}
+	config := c.settings()
+	config.KillGrace = c.killGrace
+	problems := strings.Join(config.validate("exec"), "; ")
+	for _, want := range []string{`timeout (TASK_TIMEOUT) "soon"`, `kill_grace (TASK_KILL_GRACE) "10"`, `concurrency (TASK_CONCURRENCY) "many"`, `max_attempts (TASK_MAX_ATTEMPTS) "3x"`} {
+		if !strings.Contains(problems, want) {
+			t.Errorf("got problems %q, want %s", problems, want)
+		}
+	}
+
+	// Flags win over the environment
+	if _, err := parseFlags(c.flags, []string{"--timeout", "1m", "--concurrency", "2", "--max-attempts", "0", "--kill-grace", "5s"}); err != nil {
+		t.Fatal(err)
+	}
+	config = c.settings()
+	config.KillGrace = c.killGrace
+	if problems := config.validate("exec"); len(problems) != 0 {
+		t.Errorf("got problems %q", problems)
+	}
+}
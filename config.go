@@ -0,0 +1,616 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the tasque configuration file. It is YAML, so plain JSON works
+// too. Every setting maps onto the environment variable of the same
+// meaning, and a variable that is already set wins over the file.
+type Config struct {
+	Source               string            `yaml:"source"`
+	QueueURL             string            `yaml:"queue_url"`
+	TaskTokenPath        string            `yaml:"task_token_path"`
+	ResultQueueURL       string            `yaml:"result_queue_url"`
+	ActivityARN          string            `yaml:"activity_arn"`
+	Activities           []ActivityConfig  `yaml:"activities"`
+	Timeout              string            `yaml:"timeout"`
+	Heartbeat            string            `yaml:"heartbeat"`
+	DrainTimeout         string            `yaml:"drain_timeout"`
+	VisibilityTimeout    string            `yaml:"visibility_timeout"`
+	RetryDelay           string            `yaml:"retry_delay"`
+	RetryMaxDelay        string            `yaml:"retry_max_delay"`
+	Retry                map[string]string `yaml:"retry"`
+	KillGrace            string            `yaml:"kill_grace"`
+	PayloadMode          string            `yaml:"payload_mode"`
+	PayloadDir           string            `yaml:"payload_dir"`
+	BlobStore            string            `yaml:"blob_store"`
+	BlobDir              string            `yaml:"blob_dir"`
+	SNSCertificate       string            `yaml:"sns_certificate"`
+	MaxAttempts          int               `yaml:"max_attempts"`
+	Quarantine           string            `yaml:"quarantine"`
+	Daemon               bool              `yaml:"daemon"`
+	Concurrency          *int              `yaml:"concurrency"`
+	BatchSize            *int              `yaml:"batch_size"`
+	Exit                 map[string]string `yaml:"exit"`
+	ErrorMessageTemplate string            `yaml:"error_message_template"`
+	Docker               DockerConfig      `yaml:"docker"`
+	ECS                  ECSConfig         `yaml:"ecs"`
+	AWS                  AWSSettings       `yaml:"aws"`
+	// payload is TASK_PAYLOAD, which has no place in a file
+	payload string
+	// problems found while parsing, reported by validate
+	problems []string
+}
+
+// DockerConfig configures the docker command
+type DockerConfig struct {
+	ContainerName  string                `yaml:"container_name"`
+	TaskDefinition *DockerTaskDefinition `yaml:"task_definition"`
+	Endpoint       string                `yaml:"endpoint"`
+}
+
+// ECSConfig configures the ecs command
+type ECSConfig struct {
+	TaskDefinition string `yaml:"task_definition"`
+	ContainerName  string `yaml:"container_name"`
+}
+
+// ActivityConfig is one of several Step Functions activities served at once,
+// with what its executable does differently from the command's
+type ActivityConfig struct {
+	ActivityARN string `yaml:"activity_arn" json:"activity_arn"`
+	// Concurrency defaults to TASK_CONCURRENCY
+	Concurrency int    `yaml:"concurrency" json:"concurrency,omitempty"`
+	Timeout     string `yaml:"timeout" json:"timeout,omitempty"`
+	// Command replaces the exec command's
+	Command []string `yaml:"command" json:"command,omitempty"`
+	// Image replaces the docker task definition's ImageName
+	Image string `yaml:"image" json:"image,omitempty"`
+	// TaskDefinition replaces the ecs task definition
+	TaskDefinition string `yaml:"task_definition" json:"task_definition,omitempty"`
+	ContainerName  string `yaml:"container_name" json:"container_name,omitempty"`
+}
+
+// AWSSettings configures every AWS client
+type AWSSettings struct {
+	Region      string `yaml:"region"`
+	Profile     string `yaml:"profile"`
+	RoleARN     string `yaml:"role_arn"`
+	ExternalID  string `yaml:"external_id"`
+	SQSEndpoint string `yaml:"sqs_endpoint"`
+	SFNEndpoint string `yaml:"sfn_endpoint"`
+	ECSEndpoint string `yaml:"ecs_endpoint"`
+	S3Endpoint  string `yaml:"s3_endpoint"`
+}
+
+// exitNames are the non-numeric exits tasque reports, see EXIT_%s
+var exitNames = []string{"AGENT", "ATTRIBUTE", "CPU", "MEMORY", "OUTPUT", "PARAMETER", "PAYLOAD", "RESOURCE", "TIMEOUT", "UNKNOWN"}
+
+func loadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		typeError, ok := err.(*yaml.TypeError)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		// Keep going so that validate reports these with everything else
+		config.problems = append(config.problems, typeError.Errors...)
+	}
+	return config, nil
+}
+
+// env lists the string settings by environment variable
+func (config *Config) env() map[string]*string {
+	return map[string]*string{
+		"TASK_SOURCE":             &config.Source,
+		"TASK_QUEUE_URL":          &config.QueueURL,
+		"TASK_TOKEN_PATH":         &config.TaskTokenPath,
+		"TASK_RESULT_QUEUE_URL":   &config.ResultQueueURL,
+		"TASK_ACTIVITY_ARN":       &config.ActivityARN,
+		"TASK_TIMEOUT":            &config.Timeout,
+		"TASK_HEARTBEAT":          &config.Heartbeat,
+		"TASK_DRAIN_TIMEOUT":      &config.DrainTimeout,
+		"TASK_VISIBILITY_TIMEOUT": &config.VisibilityTimeout,
+		"TASK_RETRY_DELAY":        &config.RetryDelay,
+		"TASK_RETRY_MAX_DELAY":    &config.RetryMaxDelay,
+		"TASK_KILL_GRACE":         &config.KillGrace,
+		"TASK_PAYLOAD_MODE":       &config.PayloadMode,
+		"TASK_PAYLOAD_DIR":        &config.PayloadDir,
+		"TASK_BLOB_STORE":         &config.BlobStore,
+		"TASK_BLOB_DIR":           &config.BlobDir,
+		"AWS_REGION":              &config.AWS.Region,
+		"AWS_PROFILE":             &config.AWS.Profile,
+		"TASK_ROLE_ARN":           &config.AWS.RoleARN,
+		"TASK_EXTERNAL_ID":        &config.AWS.ExternalID,
+		"AWS_SQS_ENDPOINT":        &config.AWS.SQSEndpoint,
+		"AWS_SFN_ENDPOINT":        &config.AWS.SFNEndpoint,
+		"AWS_ECS_ENDPOINT":        &config.AWS.ECSEndpoint,
+		"AWS_S3_ENDPOINT":         &config.AWS.S3Endpoint,
+		"TASK_SNS_CERTIFICATE":    &config.SNSCertificate,
+		"TASK_QUARANTINE":         &config.Quarantine,
+		"ERROR_MESSAGE_TEMPLATE":  &config.ErrorMessageTemplate,
+		"DOCKER_CONTAINER_NAME":   &config.Docker.ContainerName,
+		"DOCKER_ENDPOINT":         &config.Docker.Endpoint,
+		"ECS_TASK_DEFINITION":     &config.ECS.TaskDefinition,
+		"ECS_CONTAINER_NAME":      &config.ECS.ContainerName,
+	}
+}
+
+// setenv exports the file's settings for every environment variable that
+// isn't already set
+func (config *Config) setenv() {
+	for key, value := range config.env() {
+		setenvDefault(key, *value)
+	}
+	if config.Daemon {
+		setenvDefault("TASK_DAEMON", "true")
+	}
+	if config.Concurrency != nil {
+		setenvDefault("TASK_CONCURRENCY", strconv.Itoa(*config.Concurrency))
+	}
+	if config.BatchSize != nil {
+		setenvDefault("TASK_BATCH_SIZE", strconv.Itoa(*config.BatchSize))
+	}
+	if config.MaxAttempts != 0 {
+		setenvDefault("TASK_MAX_ATTEMPTS", strconv.Itoa(config.MaxAttempts))
+	}
+	for exit, translation := range config.Exit {
+		setenvDefault(fmt.Sprintf("EXIT_%s", exit), translation)
+	}
+	for exit, delay := range config.Retry {
+		setenvDefault(fmt.Sprintf("RETRY_%s", exit), delay)
+	}
+	if config.Docker.TaskDefinition != nil {
+		taskDefinition, _ := json.Marshal(config.Docker.TaskDefinition)
+		setenvDefault("DOCKER_TASK_DEFINITION", string(taskDefinition))
+	}
+	if len(config.Activities) > 0 {
+		activities, _ := json.Marshal(config.Activities)
+		setenvDefault("TASK_ACTIVITIES", string(activities))
+	}
+}
+
+// overlayEnv replaces the file's settings with the environment variables
+// that are set, giving the configuration tasque will actually run with
+func (config *Config) overlayEnv() {
+	for key, value := range config.env() {
+		if env := os.Getenv(key); env != "" {
+			*value = env
+		}
+	}
+	if env := os.Getenv("TASK_DAEMON"); env != "" {
+		daemon, err := strconv.ParseBool(env)
+		if err != nil {
+			config.problems = append(config.problems, fmt.Sprintf("TASK_DAEMON %q is not true or false", env))
+		}
+		config.Daemon = daemon
+	}
+	if env := os.Getenv("TASK_CONCURRENCY"); env != "" {
+		concurrency, err := strconv.Atoi(env)
+		if err != nil {
+			config.problems = append(config.problems, fmt.Sprintf("TASK_CONCURRENCY %q is not a number", env))
+		} else {
+			config.Concurrency = &concurrency
+		}
+	}
+	if env := os.Getenv("TASK_BATCH_SIZE"); env != "" {
+		batchSize, err := strconv.Atoi(env)
+		if err != nil {
+			config.problems = append(config.problems, fmt.Sprintf("TASK_BATCH_SIZE %q is not a number", env))
+		} else {
+			config.BatchSize = &batchSize
+		}
+	}
+	if env := os.Getenv("TASK_MAX_ATTEMPTS"); env != "" {
+		maxAttempts, err := strconv.Atoi(env)
+		if err != nil {
+			config.problems = append(config.problems, fmt.Sprintf("TASK_MAX_ATTEMPTS %q is not a number", env))
+		}
+		config.MaxAttempts = maxAttempts
+	}
+	config.overlayRetryEnv()
+	if env := os.Getenv("DOCKER_TASK_DEFINITION"); env != "" {
+		config.parseDockerTaskDefinition(env)
+	}
+	if env := os.Getenv("TASK_ACTIVITIES"); env != "" {
+		config.parseActivities(env)
+	}
+	if env := os.Getenv("TASK_PAYLOAD"); env != "" {
+		config.payload = env
+	}
+}
+
+// overlayRetryEnv adds the EXIT_%s and RETRY_%s environment variables, which
+// have no flags
+func (config *Config) overlayRetryEnv() {
+	for _, env := range os.Environ() {
+		parts := strings.SplitN(env, "=", 2)
+		if strings.HasPrefix(parts[0], "EXIT_") {
+			if config.Exit == nil {
+				config.Exit = map[string]string{}
+			}
+			config.Exit[strings.TrimPrefix(parts[0], "EXIT_")] = parts[1]
+		}
+		if strings.HasPrefix(parts[0], "RETRY_") {
+			if config.Retry == nil {
+				config.Retry = map[string]string{}
+			}
+			config.Retry[strings.TrimPrefix(parts[0], "RETRY_")] = parts[1]
+		}
+	}
+}
+
+func (config *Config) parseDockerTaskDefinition(value string) {
+	taskDefinition := &DockerTaskDefinition{}
+	if err := json.Unmarshal([]byte(value), taskDefinition); err != nil {
+		config.problems = append(config.problems, fmt.Sprintf("DOCKER_TASK_DEFINITION is not valid JSON: %s", err))
+	}
+	config.Docker.TaskDefinition = taskDefinition
+}
+
+func (config *Config) parseActivities(value string) {
+	var activities []ActivityConfig
+	if err := json.Unmarshal([]byte(value), &activities); err != nil {
+		config.problems = append(config.problems, fmt.Sprintf("TASK_ACTIVITIES is not valid JSON: %s", err))
+	}
+	config.Activities = activities
+}
+
+// messageSource is source (TASK_SOURCE), or else the source the other
+// settings point to
+func (config *Config) messageSource() string {
+	switch {
+	case config.Source != "":
+		return config.Source
+	case config.payload != "":
+		return "env"
+	case config.QueueURL != "":
+		return "sqs"
+	case config.ActivityARN != "" || len(config.Activities) > 0:
+		return "sfn"
+	}
+	return ""
+}
+
+// validate returns every problem with the configuration for the given
+// command (exec, docker or ecs), or the common settings when it is empty
+func (config *Config) validate(command string) []string {
+	problems := append([]string{}, config.problems...)
+	problem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	source := config.messageSource()
+	switch source {
+	case "sqs":
+		if config.QueueURL == "" {
+			problem("queue_url (TASK_QUEUE_URL) is required for the sqs source")
+		}
+	case "sfn":
+		if config.ActivityARN == "" && len(config.Activities) == 0 {
+			problem("activity_arn (TASK_ACTIVITY_ARN) or activities (TASK_ACTIVITIES) is required for the sfn source")
+		} else if config.ActivityARN != "" && len(strings.Split(config.ActivityARN, ":")) < 4 {
+			problem("activity_arn (TASK_ACTIVITY_ARN) %q is not an ARN", config.ActivityARN)
+		}
+	case "env":
+	case "":
+		problem("No message source, set source (TASK_SOURCE), queue_url (TASK_QUEUE_URL), activity_arn (TASK_ACTIVITY_ARN) or TASK_PAYLOAD")
+	default:
+		problem("source (TASK_SOURCE) %q must be sqs, sfn or env", config.Source)
+	}
+	if config.TaskTokenPath != "" && source != "sqs" {
+		problem("task_token_path (TASK_TOKEN_PATH) needs the sqs source")
+	}
+	if len(config.Activities) > 0 {
+		if source != "sfn" {
+			problem("activities (TASK_ACTIVITIES) need the sfn source")
+		}
+		if config.ActivityARN != "" {
+			problem("activity_arn (TASK_ACTIVITY_ARN) and activities (TASK_ACTIVITIES) can't both be set")
+		}
+		if !config.Daemon {
+			problem("activities (TASK_ACTIVITIES) need daemon (TASK_DAEMON)")
+		}
+	}
+	seen := map[string]bool{}
+	for i, activity := range config.Activities {
+		name := fmt.Sprintf("activities[%d]", i)
+		if activity.ActivityARN == "" {
+			problem("%s activity_arn is required", name)
+		} else if len(strings.Split(activity.ActivityARN, ":")) < 4 {
+			problem("%s activity_arn %q is not an ARN", name, activity.ActivityARN)
+		} else if seen[activity.ActivityARN] {
+			problem("%s activity_arn %q is listed twice", name, activity.ActivityARN)
+		}
+		seen[activity.ActivityARN] = true
+		if activity.Concurrency < 0 {
+			problem("%s concurrency must be at least 1", name)
+		}
+		if activity.Image != "" && !strings.Contains(activity.Image, ":") {
+			problem("%s image %q must include a tag", name, activity.Image)
+		}
+		if activity.Timeout != "" {
+			if timeout, err := time.ParseDuration(activity.Timeout); err != nil || timeout <= 0 {
+				problem("%s timeout %q is not a positive duration", name, activity.Timeout)
+			}
+		}
+		unsupported := map[string]bool{
+			"command":         len(activity.Command) > 0 && command != "exec",
+			"image":           activity.Image != "" && command != "docker",
+			"task_definition": activity.TaskDefinition != "" && command != "ecs",
+			"container_name":  activity.ContainerName != "" && command != "docker" && command != "ecs",
+		}
+		for _, setting := range []string{"command", "image", "task_definition", "container_name"} {
+			if unsupported[setting] && command != "" {
+				problem("%s %s is not supported by %s", name, setting, command)
+			}
+		}
+	}
+
+	durations := [][2]string{
+		{"timeout (TASK_TIMEOUT)", config.Timeout},
+		{"heartbeat (TASK_HEARTBEAT)", config.Heartbeat},
+		{"drain_timeout (TASK_DRAIN_TIMEOUT)", config.DrainTimeout},
+		{"kill_grace (TASK_KILL_GRACE)", config.KillGrace},
+	}
+	for _, d := range durations {
+		name, value := d[0], d[1]
+		if value == "" {
+			continue
+		}
+		if duration, err := time.ParseDuration(value); err != nil {
+			problem("%s %q is not a duration", name, value)
+		} else if duration <= 0 {
+			problem("%s must be positive", name)
+		}
+	}
+	heartbeat := durationOr(config.Heartbeat, defaultHeartbeat)
+	visibility := 2 * heartbeat
+	if config.VisibilityTimeout != "" {
+		if explicit, err := time.ParseDuration(config.VisibilityTimeout); err != nil || explicit < 0 {
+			problem("visibility_timeout (TASK_VISIBILITY_TIMEOUT) %q is not a duration of 0 or more", config.VisibilityTimeout)
+		} else if explicit != 0 {
+			visibility = explicit
+			if heartbeat > 0 && visibility <= heartbeat {
+				problem("visibility_timeout (TASK_VISIBILITY_TIMEOUT) must be longer than heartbeat (TASK_HEARTBEAT)")
+			}
+		}
+	}
+	if visibility > sqsMaxVisibility {
+		problem("visibility_timeout (TASK_VISIBILITY_TIMEOUT), twice the heartbeat unless set, must be %s or less", sqsMaxVisibility)
+	}
+	retryDelay, retryMaxDelay := defaultRetryDelay, defaultRetryMaxDelay
+	if config.RetryDelay != "" {
+		var err error
+		if retryDelay, err = time.ParseDuration(config.RetryDelay); err != nil || retryDelay < 0 {
+			problem("retry_delay (TASK_RETRY_DELAY) %q is not a duration of 0 or more", config.RetryDelay)
+		}
+	}
+	if config.RetryMaxDelay != "" {
+		var err error
+		if retryMaxDelay, err = time.ParseDuration(config.RetryMaxDelay); err != nil || retryMaxDelay <= 0 {
+			problem("retry_max_delay (TASK_RETRY_MAX_DELAY) %q is not a positive duration", config.RetryMaxDelay)
+		}
+	}
+	if retryMaxDelay < retryDelay {
+		problem("retry_max_delay (TASK_RETRY_MAX_DELAY) must be at least retry_delay (TASK_RETRY_DELAY)")
+	}
+	if retryMaxDelay > sqsMaxVisibility {
+		problem("retry_max_delay (TASK_RETRY_MAX_DELAY) must be %s or less", sqsMaxVisibility)
+	}
+	for _, exit := range sortedKeys(config.Retry) {
+		delay, err := time.ParseDuration(config.Retry[exit])
+		if err != nil || delay < 0 {
+			problem("retry %s (RETRY_%s) %q is not a duration of 0 or more", exit, exit, config.Retry[exit])
+		}
+		if !isExit(exit) {
+			problem("retry %s (RETRY_%s) must be an exit code from 1 to 255 or one of %s", exit, exit, strings.Join(exitNames, ", "))
+		}
+	}
+	if _, err := parsePayloadMode(config.PayloadMode); err != nil {
+		problem("payload_mode (TASK_PAYLOAD_MODE) %q must be env, stdin, file or all", config.PayloadMode)
+	}
+	switch config.BlobStore {
+	case "", "s3":
+	case "local":
+		if config.BlobDir == "" {
+			problem("blob_dir (TASK_BLOB_DIR) is required for the local blob store")
+		}
+	default:
+		problem("blob_store (TASK_BLOB_STORE) %q must be s3 or local", config.BlobStore)
+	}
+	if config.AWS.ExternalID != "" && config.AWS.RoleARN == "" {
+		problem("aws external_id (TASK_EXTERNAL_ID) needs aws role_arn (TASK_ROLE_ARN)")
+	}
+	if config.MaxAttempts < 0 {
+		problem("max_attempts (TASK_MAX_ATTEMPTS) must be 0 or more")
+	}
+	if config.MaxAttempts > 0 && source != "sqs" {
+		problem("max_attempts (TASK_MAX_ATTEMPTS) needs the sqs source, Step Functions tasks are retried by the state machine")
+	} else if config.MaxAttempts > 0 && (config.Quarantine == "" || config.Quarantine == "sfn" && config.TaskTokenPath == "") {
+		problem("max_attempts (TASK_MAX_ATTEMPTS) needs a quarantine (TASK_QUARANTINE) queue or directory, or sfn with task_token_path (TASK_TOKEN_PATH)")
+	}
+	if config.SNSCertificate != "" {
+		if _, err := loadSNSCertificate(config.SNSCertificate); err != nil {
+			problem("sns_certificate (TASK_SNS_CERTIFICATE) %s", err)
+		}
+	}
+	if config.Concurrency != nil && *config.Concurrency < 1 {
+		problem("concurrency (TASK_CONCURRENCY) must be at least 1")
+	}
+	if config.BatchSize != nil && (*config.BatchSize < 1 || *config.BatchSize > sqsMaxBatch) {
+		problem("batch_size (TASK_BATCH_SIZE) must be between 1 and %d", sqsMaxBatch)
+	}
+
+	for _, exit := range sortedKeys(config.Exit) {
+		if !isExit(exit) {
+			problem("exit %s (EXIT_%s) must be an exit code from 1 to 255 or one of %s", exit, exit, strings.Join(exitNames, ", "))
+		}
+	}
+
+	if config.ErrorMessageTemplate != "" {
+		if _, err := template.New("errormsg").Parse(config.ErrorMessageTemplate); err != nil {
+			problem("error_message_template (ERROR_MESSAGE_TEMPLATE) %s", err)
+		}
+	}
+
+	switch command {
+	case "docker":
+		if config.Docker.ContainerName == "" && !config.everyActivity(func(a ActivityConfig) bool { return a.ContainerName != "" }) {
+			problem("docker.container_name (DOCKER_CONTAINER_NAME) is required")
+		}
+		if config.Docker.TaskDefinition == nil {
+			problem("docker.task_definition (DOCKER_TASK_DEFINITION) is required")
+		} else if !strings.Contains(config.Docker.TaskDefinition.ImageName, ":") {
+			problem("docker.task_definition ImageName %q must include a tag", config.Docker.TaskDefinition.ImageName)
+		}
+	case "ecs":
+		if config.PayloadMode == "stdin" {
+			problem("payload_mode (TASK_PAYLOAD_MODE) stdin is not supported by ecs")
+		}
+		if config.ECS.TaskDefinition == "" && !config.everyActivity(func(a ActivityConfig) bool { return a.TaskDefinition != "" }) {
+			problem("ecs.task_definition (ECS_TASK_DEFINITION) is required")
+		}
+		if config.ECS.ContainerName == "" && !config.everyActivity(func(a ActivityConfig) bool { return a.ContainerName != "" }) {
+			problem("ecs.container_name (ECS_CONTAINER_NAME) is required")
+		}
+	case "exec", "":
+	default:
+		problem("unknown command %q, expecting exec, docker or ecs", command)
+	}
+	return problems
+}
+
+// everyActivity says whether there are activities and all of them satisfy f
+func (config *Config) everyActivity(f func(ActivityConfig) bool) bool {
+	for _, activity := range config.Activities {
+		if !f(activity) {
+			return false
+		}
+	}
+	return len(config.Activities) > 0
+}
+
+// parseFlags parses the command line. When a config file is given the flags
+// are parsed a second time, after the file has supplied the environment
+// variables that the flag defaults come from.
+func parseFlags(newFlags func() *flag.FlagSet, args []string) (*flag.FlagSet, error) {
+	flags := newFlags()
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	path := flags.Lookup("config").Value.String()
+	if path == "" {
+		return flags, nil
+	}
+	config, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.problems) > 0 {
+		return nil, fmt.Errorf("%s: %s", path, strings.Join(config.problems, "; "))
+	}
+	config.setenv()
+	flags = newFlags()
+	return flags, flags.Parse(args)
+}
+
+// durationOr parses value, fallback when it's empty or not a duration
+func durationOr(value string, fallback time.Duration) time.Duration {
+	if duration, err := time.ParseDuration(value); err == nil {
+		return duration
+	}
+	return fallback
+}
+
+func setenvDefault(key string, value string) {
+	if value != "" && os.Getenv(key) == "" {
+		os.Setenv(key, value)
+	}
+}
+
+// isExit says whether exit is something result.SetExit can be called with
+func isExit(exit string) bool {
+	if code, err := strconv.Atoi(exit); err == nil {
+		return code >= 1 && code <= 255
+	}
+	return stringInSlice(exit, exitNames)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfigValidateCommand checks a configuration file
+type ConfigValidateCommand struct {
+	config string
+}
+
+func (c *ConfigValidateCommand) flags() *flag.FlagSet {
+	flags := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	flags.StringVar(&c.config, "config", os.Getenv("TASK_CONFIG"), "Configuration file (TASK_CONFIG)")
+	return flags
+}
+
+func (c *ConfigValidateCommand) Help() string {
+	return usage("tasque config validate [options] [exec|docker|ecs]", "Report every problem with the configuration file and environment, checking the settings the given command needs.", c.flags())
+}
+
+func (c *ConfigValidateCommand) Synopsis() string {
+	return "Check the configuration"
+}
+
+func (c *ConfigValidateCommand) Run(args []string) int {
+	flags := c.flags()
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	config := &Config{}
+	if c.config != "" {
+		var err error
+		if config, err = loadConfig(c.config); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	config.overlayEnv()
+	problems := config.validate(flags.Arg(0))
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	fmt.Println("Configuration is valid")
+	return 0
+}
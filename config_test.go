@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func intPointer(i int) *int {
+	return &i
+}
+
+func TestConfigValidate(t *testing.T) {
+	const queueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/tasks"
+	const activityARN = "arn:aws:states:us-east-1:123456789012:activity:tasks"
+	tests := []struct {
+		name    string
+		command string
+		config  Config
+		// problem is part of the one problem expected, none when empty
+		problem string
+	}{
+		{"sqs", "exec", Config{QueueURL: queueURL}, ""},
+		{"sfn", "exec", Config{ActivityARN: activityARN}, ""},
+		{"env", "exec", Config{payload: `{"a":1}`}, ""},
+		{"no source", "exec", Config{}, "No message source"},
+		{"unknown source", "exec", Config{Source: "kafka", QueueURL: queueURL}, `source (TASK_SOURCE) "kafka"`},
+		{"sqs without queue", "exec", Config{Source: "sqs"}, "queue_url (TASK_QUEUE_URL) is required"},
+		{"bad activity_arn", "exec", Config{ActivityARN: "tasks"}, "is not an ARN"},
+		{"activities without activity_arn", "exec", Config{
+			Daemon:     true,
+			Activities: []ActivityConfig{{ActivityARN: activityARN}, {ActivityARN: activityARN + "2", Concurrency: 2}},
+		}, ""},
+		{"activities and activity_arn", "exec", Config{
+			Daemon:      true,
+			ActivityARN: activityARN,
+			Activities:  []ActivityConfig{{ActivityARN: activityARN + "2"}},
+		}, "can't both be set"},
+		{"activities without daemon", "exec", Config{
+			Activities: []ActivityConfig{{ActivityARN: activityARN}},
+		}, "need daemon"},
+		{"activity listed twice", "exec", Config{
+			Daemon:     true,
+			Activities: []ActivityConfig{{ActivityARN: activityARN}, {ActivityARN: activityARN}},
+		}, "listed twice"},
+		{"activity image for exec", "exec", Config{
+			Daemon:     true,
+			Activities: []ActivityConfig{{ActivityARN: activityARN, Image: "worker:1"}},
+		}, "image is not supported by exec"},
+		{"task_token_path without sqs", "exec", Config{ActivityARN: activityARN, TaskTokenPath: "$.TaskToken"}, "needs the sqs source"},
+		{"bad timeout", "exec", Config{QueueURL: queueURL, Timeout: "soon"}, `timeout (TASK_TIMEOUT) "soon" is not a duration`},
+		{"zero heartbeat", "exec", Config{QueueURL: queueURL, Heartbeat: "0s"}, "heartbeat (TASK_HEARTBEAT) must be positive"},
+		{"visibility within heartbeat", "exec", Config{QueueURL: queueURL, Heartbeat: "1m", VisibilityTimeout: "30s"}, "must be longer than heartbeat"},
+		{"visibility too long", "exec", Config{QueueURL: queueURL, VisibilityTimeout: "13h"}, "must be 12h0m0s or less"},
+		{"default visibility too long", "exec", Config{QueueURL: queueURL, Heartbeat: "7h"}, "twice the heartbeat unless set"},
+		{"retry delay over max", "exec", Config{QueueURL: queueURL, RetryDelay: "10m", RetryMaxDelay: "1m"}, "must be at least retry_delay"},
+		{"unknown retry exit", "exec", Config{QueueURL: queueURL, Retry: map[string]string{"LATER": "1m"}}, "retry LATER (RETRY_LATER) must be an exit code"},
+		{"zero concurrency", "exec", Config{QueueURL: queueURL, Concurrency: intPointer(0)}, "concurrency (TASK_CONCURRENCY) must be at least 1"},
+		{"batch too large", "exec", Config{QueueURL: queueURL, BatchSize: intPointer(11)}, "batch_size (TASK_BATCH_SIZE) must be between 1 and 10"},
+		{"max_attempts without quarantine", "exec", Config{QueueURL: queueURL, MaxAttempts: 3}, "needs a quarantine"},
+		{"max_attempts for sfn", "exec", Config{ActivityARN: activityARN, MaxAttempts: 3}, "needs the sqs source"},
+		{"max_attempts with sfn quarantine", "exec", Config{QueueURL: queueURL, MaxAttempts: 3, Quarantine: "sfn"}, "or sfn with task_token_path"},
+		{"max_attempts with sfn quarantine and task tokens", "exec", Config{QueueURL: queueURL, MaxAttempts: 3, Quarantine: "sfn", TaskTokenPath: "$.TaskToken"}, ""},
+		{"local blob store without dir", "exec", Config{QueueURL: queueURL, BlobStore: "local"}, "blob_dir (TASK_BLOB_DIR) is required"},
+		{"external_id without role", "exec", Config{QueueURL: queueURL, AWS: AWSSettings{ExternalID: "x"}}, "needs aws role_arn"},
+		{"parse problems", "exec", Config{QueueURL: queueURL, problems: []string{"TASK_ACTIVITIES is not valid JSON"}}, "TASK_ACTIVITIES is not valid JSON"},
+	}
+	for _, test := range tests {
+		problems := test.config.validate(test.command)
+		if test.problem == "" {
+			if len(problems) > 0 {
+				t.Errorf("%s: unexpected problems %q", test.name, problems)
+			}
+			continue
+		}
+		if len(problems) != 1 || !strings.Contains(problems[0], test.problem) {
+			t.Errorf("%s: got problems %q, want one containing %q", test.name, problems, test.problem)
+		}
+	}
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"strings"
 	"time"
 
@@ -23,14 +27,14 @@ type AuthData struct {
 	Server string `json:"server"`
 }
 
-//DockerTaskDefinition is the varaible setting requests set by the user
+// DockerTaskDefinition is the varaible setting requests set by the user
 type DockerTaskDefinition struct {
-	ImageName  string   `json:"ImageName"`
-	MacAddress string   `json:"MacAddress"`
-	Env        []string `json:"Env"`
+	ImageName  string   `json:"ImageName" yaml:"ImageName"`
+	MacAddress string   `json:"MacAddress" yaml:"MacAddress"`
+	Env        []string `json:"Env" yaml:"Env"`
 }
 
-//AWSDOCKER is a dockerobj. It is identified by an image containerName
+// AWSDOCKER is a dockerobj. It is identified by an image containerName
 type AWSDOCKER struct {
 	containerName        string
 	taskArn              string
@@ -39,21 +43,66 @@ type AWSDOCKER struct {
 	eventsCh             chan *docker.APIEvents
 	containerArgs        string
 	dockerTaskDefinition DockerTaskDefinition
-	result               result.Result
+	payload              payloadMode
+	attributes           map[string]string
+	// stderr is the end of the container's standard error
+	stderr *tail
+	result result.Result
 }
 
-func (dockerobj AWSDOCKER) Execute(handler MessageHandler) {
-	dockerobj.execute(handler)
+// dockerPayloadFile is where the payload and dockerAttributesFile the
+// message attributes are copied to inside the container, dockerOutputFile
+// is where the container writes its output
+const (
+	dockerPayloadFile    = "/tasque/payload.json"
+	dockerAttributesFile = "/tasque/attributes.json"
+	dockerOutputFile     = "/tasque/output.json"
+)
+
+func (dockerobj AWSDOCKER) Execute(ctx context.Context, handler MessageHandler) {
+	dockerobj.attributes = handler.attributes()
+	dockerobj.stderr = &tail{}
+	dockerobj.dockerobjTimeoutHelper(ctx, handler)
 }
 
 func (executable *AWSDOCKER) Result() result.Result {
 	return executable.result
 }
 
-func (dockerobj *AWSDOCKER) createDockerContainer(messageBody *string, args []string, env []string, attachStdout bool) (string, error) {
+// alive checks that the task's container is running. There is nothing to
+// check while the image is pulled and the container created.
+func (dockerobj *AWSDOCKER) alive(ctx context.Context) bool {
+	container, err := dockerobj.dockerClient.InspectContainerWithContext(dockerobj.containerName, ctx)
+	if err != nil {
+		if _, ok := err.(*docker.NoSuchContainer); !ok {
+			log.Printf("Couldn't inspect container %s %s", dockerobj.containerName, err)
+		}
+		return true
+	}
+	return container.State.Running || container.State.Status == "created"
+}
+
+// clone gives a daemon worker its own container name and event channel so
+// that concurrent workers don't remove or listen to each other's containers.
+func (dockerobj *AWSDOCKER) clone(worker int) ExecutableInterface {
+	c := *dockerobj
+	c.containerName = fmt.Sprintf("%s-%d", dockerobj.containerName, worker)
+	c.eventsCh = make(chan *docker.APIEvents)
+	return &c
+}
+
+func (dockerobj *AWSDOCKER) createDockerContainer(ctx context.Context, messageBody *string, args []string, env []string, attachStdout bool) (string, error) {
 	var taskPayloadEnv []string
 	fmt.Println(dockerobj.dockerTaskDefinition.Env)
-	taskPayloadEnv = append(taskPayloadEnv, fmt.Sprintf("TASK_PAYLOAD=%s", *messageBody))
+	if dockerobj.payload.env {
+		taskPayloadEnv = append(taskPayloadEnv, fmt.Sprintf("TASK_PAYLOAD=%s", *messageBody))
+	}
+	if dockerobj.payload.file {
+		taskPayloadEnv = append(taskPayloadEnv, fmt.Sprintf("TASK_PAYLOAD_FILE=%s", dockerPayloadFile))
+		taskPayloadEnv = append(taskPayloadEnv, fmt.Sprintf("TASK_ATTRIBUTES_FILE=%s", dockerAttributesFile))
+	}
+	taskPayloadEnv = append(taskPayloadEnv, attributeEnv(dockerobj.payload, dockerobj.attributes)...)
+	taskPayloadEnv = append(taskPayloadEnv, fmt.Sprintf("TASK_OUTPUT_FILE=%s", dockerOutputFile))
 	taskPayloadEnv = append(taskPayloadEnv, dockerobj.dockerTaskDefinition.Env...)
 
 	dockerConfig := docker.Config{
@@ -61,24 +110,74 @@ func (dockerobj *AWSDOCKER) createDockerContainer(messageBody *string, args []st
 		Image:        dockerobj.dockerTaskDefinition.ImageName,
 		AttachStdout: attachStdout,
 		AttachStderr: attachStdout,
+		AttachStdin:  dockerobj.payload.stdin,
+		OpenStdin:    dockerobj.payload.stdin,
+		StdinOnce:    dockerobj.payload.stdin,
 		MacAddress:   dockerobj.dockerTaskDefinition.MacAddress,
 	}
-	copts := docker.CreateContainerOptions{Name: dockerobj.containerName, Config: &dockerConfig}
+	copts := docker.CreateContainerOptions{Name: dockerobj.containerName, Config: &dockerConfig, Context: ctx}
 	log.Printf("Create container for image container name: %s\n", dockerobj.dockerTaskDefinition.ImageName)
 	container, err := dockerobj.dockerClient.CreateContainer(copts)
 	if err != nil {
 		return "", err
 	}
 	log.Printf("Created container container name: %s\n", container.ID)
+	if err := dockerobj.uploadTaskDir(ctx, container.ID, messageBody); err != nil {
+		return "", err
+	}
 	return container.ID, err
 }
 
-func (dockerobj *AWSDOCKER) deployImage(args []string, env []string, reader io.Reader) error {
+// uploadTaskDir creates the directory for the payload and output files in
+// the container before it starts, the container can't see tasque's own
+// filesystem
+func (dockerobj *AWSDOCKER) uploadTaskDir(ctx context.Context, containerID string, messageBody *string) error {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	dir := strings.TrimPrefix(path.Dir(dockerPayloadFile), "/") + "/"
+	// Writable by whichever user the image runs as
+	if err := tw.WriteHeader(&tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0777}); err != nil {
+		return err
+	}
+	if dockerobj.payload.file {
+		if err := writeTarFile(tw, dockerPayloadFile, []byte(*messageBody)); err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, dockerAttributesFile, attributesJSON(dockerobj.attributes)); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return dockerobj.dockerClient.UploadToContainer(containerID, docker.UploadToContainerOptions{
+		InputStream: &archive,
+		Path:        "/",
+		Context:     ctx,
+	})
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{
+		Name:     strings.TrimPrefix(name, "/"),
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(data)),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func (dockerobj *AWSDOCKER) deployImage(ctx context.Context, args []string, env []string, reader io.Reader) error {
 	outputbuf := bytes.NewBuffer(nil)
 	result := strings.Split(dockerobj.dockerTaskDefinition.ImageName, ":")
 	opts := docker.PullImageOptions{
 		Repository: result[0],
 		Tag:        result[1],
+		Context:    ctx,
 	}
 	// We probably need to configure explicit authorization as the library/docker client doesn't appear
 	// to be authorized to pull images yet.
@@ -116,30 +215,30 @@ func fetchAuthConfiguration() (docker.AuthConfiguration, error) {
 	}, nil
 }
 
-//Deploy use the reader containing targz to create a docker image
-//for docker inputbuf is tar reader ready for use by docker.Client
-//the stream from end dockerClient to peer could directly be this tar stream
-//talk to docker daemon using docker Client and build the image
-func (dockerobj *AWSDOCKER) Deploy(args []string, env []string, reader io.Reader) error {
-	if err := dockerobj.deployImage(args, env, reader); err != nil {
+// Deploy use the reader containing targz to create a docker image
+// for docker inputbuf is tar reader ready for use by docker.Client
+// the stream from end dockerClient to peer could directly be this tar stream
+// talk to docker daemon using docker Client and build the image
+func (dockerobj *AWSDOCKER) Deploy(ctx context.Context, args []string, env []string, reader io.Reader) error {
+	if err := dockerobj.deployImage(ctx, args, env, reader); err != nil {
 		return err
 	}
 	return nil
 }
 
-//BuildSpecFactory Should be removed
+// BuildSpecFactory Should be removed
 type BuildSpecFactory func() (io.Reader, error)
 
-func (dockerobj *AWSDOCKER) stopInternal(id string, timeout uint, dontkill bool, dontremove bool) error {
+func (dockerobj *AWSDOCKER) stopInternal(ctx context.Context, id string, timeout uint, dontkill bool, dontremove bool) error {
 
-	err := dockerobj.dockerClient.StopContainer(id, timeout)
+	err := dockerobj.dockerClient.StopContainerWithContext(id, timeout, ctx)
 	if err != nil {
 		log.Printf("Stop container %s(%s)", id, err)
 	} else {
 		log.Printf("Stopped container %s", id)
 	}
 	if !dontkill {
-		err = dockerobj.dockerClient.KillContainer(docker.KillContainerOptions{ID: id})
+		err = dockerobj.dockerClient.KillContainer(docker.KillContainerOptions{ID: id, Context: ctx})
 		if err != nil {
 			log.Printf("Kill container %s (%s)", id, err)
 		} else {
@@ -147,7 +246,7 @@ func (dockerobj *AWSDOCKER) stopInternal(id string, timeout uint, dontkill bool,
 		}
 	}
 	if !dontremove {
-		err = dockerobj.dockerClient.RemoveContainer(docker.RemoveContainerOptions{ID: id, Force: true})
+		err = dockerobj.dockerClient.RemoveContainer(docker.RemoveContainerOptions{ID: id, Force: true, Context: ctx})
 		if err != nil {
 			log.Printf("Remove container %s (%s)", id, err)
 		} else {
@@ -157,8 +256,8 @@ func (dockerobj *AWSDOCKER) stopInternal(id string, timeout uint, dontkill bool,
 	return err
 }
 
-//Start starts a container using a previously created docker image
-func (dockerobj *AWSDOCKER) Start(messageBody *string, args []string, env []string, builder BuildSpecFactory, messageID *string) error {
+// Start starts a container using a previously created docker image
+func (dockerobj *AWSDOCKER) Start(ctx context.Context, messageBody *string, args []string, env []string, builder BuildSpecFactory, messageID *string) error {
 
 	attachStdout := true
 
@@ -167,14 +266,14 @@ func (dockerobj *AWSDOCKER) Start(messageBody *string, args []string, env []stri
 	//stop,force remove if necessary
 	log.Printf("Cleanup image containerName %s", dockerobj.containerName)
 
-	dockerobj.stopInternal(dockerobj.containerName, 0, false, false)
+	dockerobj.stopInternal(ctx, dockerobj.containerName, 0, false, false)
 
 	log.Printf("Start container %s", dockerobj.containerName)
 	// Pull image every time to ensure latest
-	if err := dockerobj.deployImage(args, env, nil); err != nil {
+	if err := dockerobj.deployImage(ctx, args, env, nil); err != nil {
 		return err
 	}
-	containerID, err := dockerobj.createDockerContainer(messageBody, args, env, attachStdout)
+	containerID, err := dockerobj.createDockerContainer(ctx, messageBody, args, env, attachStdout)
 	if err != nil {
 		//if image not found try to create image and retry
 		if err == docker.ErrNoSuchImage {
@@ -186,12 +285,12 @@ func (dockerobj *AWSDOCKER) Start(messageBody *string, args []string, env []stri
 				//    log.Printf("Error creating image builder: %s", err1)
 				//}
 
-				if err1 = dockerobj.deployImage(args, env, nil); err1 != nil {
+				if err1 = dockerobj.deployImage(ctx, args, env, nil); err1 != nil {
 					return err1
 				}
 
 				log.Printf("start-recreated image successfully")
-				if containerID, err1 = dockerobj.createDockerContainer(messageBody, args, env, attachStdout); err1 != nil {
+				if containerID, err1 = dockerobj.createDockerContainer(ctx, messageBody, args, env, attachStdout); err1 != nil {
 					log.Printf("start-could not recreate container post recreate image: %s", err1)
 					return err1
 				}
@@ -205,32 +304,42 @@ func (dockerobj *AWSDOCKER) Start(messageBody *string, args []string, env []stri
 		}
 	}
 	dockerobj.taskArn = containerID
+	if len(containerID) >= 12 {
+		dockerobj.result.SetHost(containerID[:12])
+	}
 
 	if attachStdout {
 		// Launch a few go-threads to manage output streams from the container.
 		// They will be automatically destroyed when the container exits
 		attached := make(chan struct{})
-		r, w := io.Pipe()
+		stdoutReader, stdoutWriter := io.Pipe()
+		stderrReader, stderrWriter := io.Pipe()
 
 		go func() {
 			// AttachToContainer will fire off a message on the "attached" channel once the
 			// attachment completes, and then block until the container is terminated.
 			// The returned error is not used outside the scope of this function. Assign the
 			// error to a local variable to prevent clobbering the function variable 'err'.
-			err := dockerobj.dockerClient.AttachToContainer(docker.AttachToContainerOptions{
+			opts := docker.AttachToContainerOptions{
 				Container:    containerID,
-				OutputStream: w,
-				ErrorStream:  w,
+				OutputStream: stdoutWriter,
+				ErrorStream:  stderrWriter,
 				Logs:         true,
 				Stdout:       true,
 				Stderr:       true,
 				Stream:       true,
 				Success:      attached,
-			})
+			}
+			if dockerobj.payload.stdin {
+				opts.InputStream = strings.NewReader(*messageBody)
+				opts.Stdin = true
+			}
+			err := dockerobj.dockerClient.AttachToContainer(opts)
 
 			// If we get here, the container has terminated.  Send a signal on the pipe
 			// so that downstream may clean up appropriately
-			_ = w.CloseWithError(err)
+			_ = stdoutWriter.CloseWithError(err)
+			_ = stderrWriter.CloseWithError(err)
 		}()
 
 		go func() {
@@ -248,31 +357,12 @@ func (dockerobj *AWSDOCKER) Start(messageBody *string, args []string, env []stri
 			// appear to hurt anything.
 			attached <- struct{}{}
 
-			// Establish a buffer for our IO channel so that we may do readline-style
-			// ingestion of the IO, one log entry per line
-			is := bufio.NewReader(r)
-
-			for {
-				// Loop forever dumping lines of text into the containerLogger
-				// until the pipe is closed
-				line, err2 := is.ReadString('\n')
-				if err2 != nil {
-					switch err2 {
-					case io.EOF:
-						log.Printf("Container %s has closed its IO channel", containerID)
-					default:
-						log.Printf("Error reading container output: %s", err2)
-					}
-
-					return
-				}
-
-				log.Printf(line)
-			}
+			go dockerobj.readStream(containerID, stderrReader, dockerobj.stderr)
+			dockerobj.readStream(containerID, stdoutReader, nil)
 		}()
 	}
 
-	err = dockerobj.dockerClient.StartContainer(containerID, nil)
+	err = dockerobj.dockerClient.StartContainerWithContext(containerID, nil, ctx)
 	if err != nil {
 		log.Printf("start-could not start container: %s", err)
 		return err
@@ -282,20 +372,49 @@ func (dockerobj *AWSDOCKER) Start(messageBody *string, args []string, env []stri
 	return nil
 }
 
-//Stop stops a running chaincode
-func (dockerobj *AWSDOCKER) Stop(id string, timeout uint, dontkill bool, dontremove bool) error {
+// readStream logs the lines of one of the container's output streams until
+// the pipe is closed, keeping the last of them in lines if it's set
+func (dockerobj *AWSDOCKER) readStream(containerID string, r io.Reader, lines *tail) {
+	// Establish a buffer for our IO channel so that we may do readline-style
+	// ingestion of the IO, one log entry per line
+	is := bufio.NewReader(r)
+
+	for {
+		// Loop forever dumping lines of text into the containerLogger
+		// until the pipe is closed
+		line, err := is.ReadString('\n')
+		if err != nil {
+			switch err {
+			case io.EOF:
+				log.Printf("Container %s has closed its IO channel", containerID)
+			default:
+				log.Printf("Error reading container output: %s", err)
+			}
+
+			return
+		}
+
+		log.Print(line)
+		if lines != nil {
+			lines.add(strings.TrimRight(line, "\n"))
+		}
+	}
+}
+
+// Stop stops a running chaincode
+func (dockerobj *AWSDOCKER) Stop(ctx context.Context, id string, timeout uint, dontkill bool, dontremove bool) error {
 
 	id = strings.Replace(id, ":", "_", -1)
-	err := dockerobj.stopInternal(id, timeout, dontkill, dontremove)
+	err := dockerobj.stopInternal(ctx, id, timeout, dontkill, dontremove)
 
 	return err
 }
 
-//Destroy destroys an image
-func (dockerobj *AWSDOCKER) Destroy(id string, force bool, noprune bool) error {
+// Destroy destroys an image
+func (dockerobj *AWSDOCKER) Destroy(ctx context.Context, id string, force bool, noprune bool) error {
 	id = strings.Replace(id, ":", "_", -1)
 
-	err := dockerobj.dockerClient.RemoveImageExtended(id, docker.RemoveImageOptions{Force: force, NoPrune: noprune})
+	err := dockerobj.dockerClient.RemoveImageExtended(id, docker.RemoveImageOptions{Force: force, NoPrune: noprune, Context: ctx})
 
 	if err != nil {
 		log.Printf("error while destroying image: %s", err)
@@ -306,36 +425,24 @@ func (dockerobj *AWSDOCKER) Destroy(id string, force bool, noprune bool) error {
 	return err
 }
 
-func (dockerobj AWSDOCKER) execute(handler MessageHandler) {
-	handler.initialize()
-	if handler.receive() {
-		dockerobj.dockerobjTimeoutHelper(handler)
+func (dockerobj *AWSDOCKER) dockerobjTimeoutHelper(ctx context.Context, handler MessageHandler) {
+	run := func(ctx context.Context, started chan<- stopper) error {
+		return dockerobj.executionHelper(ctx, handler.body(), handler.id(), started)
 	}
-}
-
-func (dockerobj *AWSDOCKER) dockerobjTimeoutHelper(handler MessageHandler) {
-	ch := make(chan error)
-	go func() {
-		ch <- dockerobj.executionHelper(handler.body(), handler.id())
-	}()
-	select {
-	case err := <-ch:
-		if err != nil {
-			log.Printf("E: %s %s", dockerobj.containerName, err.Error())
-			handler.failure(dockerobj.result)
-		} else {
-			log.Printf("I: %s finished successfully", dockerobj.containerName)
-			handler.success()
+	runTask(ctx, handler, dockerobj.containerName, dockerobj.timeout, &dockerobj.result, run, func(err error) {
+		if err != nil && dockerobj.result.Exit == "" {
+			dockerobj.result.SetExit("UNKNOWN")
 		}
-	case <-time.After(dockerobj.timeout):
-		err := fmt.Errorf("%s timed out after %f seconds", dockerobj.containerName, dockerobj.timeout.Seconds())
-		log.Println(err)
-		handler.failure(dockerobj.result)
-	}
+	})
 }
 
-func (dockerobj *AWSDOCKER) executionHelper(messageBody *string, messageID *string) error {
+func (dockerobj *AWSDOCKER) executionHelper(ctx context.Context, messageBody *string, messageID *string, started chan<- stopper) error {
 	var err error
+	// The container is named up front, so it can be stopped however far
+	// Start got
+	started <- func(exited <-chan struct{}) {
+		dockerobj.stopInternal(context.Background(), dockerobj.containerName, 10, false, false)
+	}
 
 	args := make([]string, 1)
 	env := make([]string, 1)
@@ -344,24 +451,27 @@ func (dockerobj *AWSDOCKER) executionHelper(messageBody *string, messageID *stri
 	//taskArn, err = dockerobj.startECSTask(messageBody, messageID)
 	//dockerobj.taskArn = taskArn
 
-	err = dockerobj.Start(messageBody, args, env, nil, messageID)
+	err = dockerobj.Start(ctx, messageBody, args, env, nil, messageID)
 	if err != nil {
 		return err
 	}
-	err = dockerobj.monitorDocker()
+	err = dockerobj.monitorDocker(ctx)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (dockerobj *AWSDOCKER) monitorDocker() error {
+func (dockerobj *AWSDOCKER) monitorDocker(ctx context.Context) error {
 	dockerobj.addListener()
 	// Monitor docker events for sibling Projector task
-	status, err := dockerobj.listenForDie()
+	status, err := dockerobj.listenForDie(ctx)
 	if err != nil {
 		return err
 	}
+	dockerobj.result.SetExit(status)
+	dockerobj.result.Output = dockerobj.downloadOutput(ctx)
+	dockerobj.result.Stderr = dockerobj.stderr.String()
 
 	if status == "0" {
 		// status is die
@@ -377,11 +487,34 @@ func (dockerobj *AWSDOCKER) monitorDocker() error {
 
 }
 
-func (dockerobj *AWSDOCKER) listenForDie() (exitCode string, err error) {
+// downloadOutput copies the output file out of the stopped container
+func (dockerobj *AWSDOCKER) downloadOutput(ctx context.Context) string {
+	var archive bytes.Buffer
+	err := dockerobj.dockerClient.DownloadFromContainer(dockerobj.taskArn, docker.DownloadFromContainerOptions{
+		Path:         dockerOutputFile,
+		OutputStream: &archive,
+		Context:      ctx,
+	})
+	if err != nil {
+		log.Printf("Couldn't read task output %s", err)
+		return ""
+	}
+	tr := tar.NewReader(&archive)
+	if _, err := tr.Next(); err != nil {
+		log.Printf("Couldn't read task output %s", err)
+		return ""
+	}
+	output, err := ioutil.ReadAll(tr)
+	if err != nil {
+		log.Printf("Couldn't read task output %s", err)
+		return ""
+	}
+	return string(output)
+}
+
+func (dockerobj *AWSDOCKER) listenForDie(ctx context.Context) (exitCode string, err error) {
 	log.Printf("[INFO] Monitoring Docker events.")
 	log.Printf("[DEBUG] %+v\n", dockerobj)
-	duration := getTimeout()
-	timeout := time.After(duration)
 	defer dockerobj.removeListener()
 	for {
 		select {
@@ -397,9 +530,9 @@ func (dockerobj *AWSDOCKER) listenForDie() (exitCode string, err error) {
 					}
 				}
 			}
-		case <-timeout:
+		case <-ctx.Done():
 			log.Printf("[INFO] Instance timeout reached.")
-			err := fmt.Errorf("Docker container %s timed out after %f seconds", dockerobj.containerName, duration.Seconds())
+			err := fmt.Errorf("Docker container %s timed out after %f seconds", dockerobj.containerName, dockerobj.timeout.Seconds())
 			return "timeout", err
 		}
 	}
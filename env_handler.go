@@ -1,11 +1,15 @@
 package main
 
-import "os"
-import "github.com/blaines/tasque-go/result"
+import (
+	"context"
+
+	"github.com/blaines/tasque-go/result"
+)
 
 // ENVHandler hello world
 type ENVHandler struct {
 	messageID, messageBody string
+	payload                string
 }
 
 func (handler *ENVHandler) id() *string {
@@ -16,14 +20,20 @@ func (handler *ENVHandler) body() *string {
 	return &handler.messageBody
 }
 
+func (handler *ENVHandler) attributes() map[string]string {
+	return nil
+}
+
 func (handler *ENVHandler) initialize() {}
 
-func (handler *ENVHandler) receive() bool {
+func (handler *ENVHandler) receive(ctx context.Context) bool {
 	handler.messageID = "development"
-	handler.messageBody = os.Getenv("TASK_PAYLOAD")
+	handler.messageBody = handler.payload
 	return true
 }
 
-func (handler *ENVHandler) success()                  {}
-func (handler *ENVHandler) failure(err result.Result) {}
-func (handler *ENVHandler) heartbeat()                {}
+func (handler *ENVHandler) success(ctx context.Context, result result.Result) {}
+func (handler *ENVHandler) failure(ctx context.Context, err result.Result)    {}
+func (handler *ENVHandler) heartbeat(ctx context.Context) error               { return nil }
+func (handler *ENVHandler) release(ctx context.Context)                       {}
+func (handler *ENVHandler) discard(ctx context.Context, err result.Result)    {}
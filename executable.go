@@ -2,12 +2,16 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -16,46 +20,74 @@ import (
 
 // Executable hello world
 type Executable struct {
-	binary    string
-	arguments []string
-	stdin     bufio.Scanner
-	stdout    bufio.Scanner
-	stderr    bufio.Scanner
-	timeout   time.Duration
-	result    result.Result
+	binary     string
+	arguments  []string
+	stdin      bufio.Scanner
+	stdout     bufio.Scanner
+	stderr     bufio.Scanner
+	timeout    time.Duration
+	killGrace  time.Duration
+	payload    payloadMode
+	payloadDir string
+	result     result.Result
+	// pid is the running task's, 0 when there is none
+	pid int64
 }
 
-func (executable *Executable) Execute(handler MessageHandler) {
-	executable.execute(handler)
+func (executable *Executable) Execute(ctx context.Context, handler MessageHandler) {
+	executable.executableTimeoutHelper(ctx, handler)
 }
 
 func (executable *Executable) Result() result.Result {
 	return executable.result
 }
 
-func (executable *Executable) execute(handler MessageHandler) {
-	handler.initialize()
-	if handler.receive() {
-		executable.executableTimeoutHelper(handler)
+func (executable *Executable) clone(worker int) ExecutableInterface {
+	c := *executable
+	return &c
+}
+
+// alive checks that the task's process still exists
+func (executable *Executable) alive(ctx context.Context) bool {
+	pid := atomic.LoadInt64(&executable.pid)
+	if pid == 0 {
+		return true
 	}
+	return syscall.Kill(int(pid), 0) == nil
 }
 
-func (executable *Executable) executableTimeoutHelper(handler MessageHandler) {
-	ch := make(chan error)
-	go func() {
-		ch <- executionHelper(executable.binary, executable.arguments, handler.body(), handler.id())
-	}()
-	select {
-	case err := <-ch:
-		if err != nil {
-			log.Printf("E: %s %s", executable.binary, err.Error())
-			handler.failure(executable.result)
+func (executable *Executable) executableTimeoutHelper(ctx context.Context, handler MessageHandler) {
+	run := func(ctx context.Context, started chan<- stopper) error {
+		return executable.executionHelper(handler.body(), handler.id(), handler.attributes(), started)
+	}
+	runTask(ctx, handler, executable.binary, executable.timeout, &executable.result, run, func(err error) {
+		if err == nil {
+			executable.result.SetExit("0")
+		} else if exitErr, ok := err.(*exec.ExitError); ok {
+			executable.result.SetExit(strconv.Itoa(exitStatus(exitErr)))
 		} else {
-			log.Printf("I: %s finished successfully", executable.binary)
-			handler.success()
+			executable.result.SetExit("UNKNOWN")
 		}
-	case <-time.After(executable.timeout):
-		log.Printf("E: %s timed out after %f seconds", executable.binary, executable.timeout.Seconds())
+	})
+}
+
+// terminate sends SIGTERM to the command's process group, followed by
+// SIGKILL if it hasn't exited once the grace period is over
+func (executable *Executable) terminate(command *exec.Cmd, exited <-chan struct{}) {
+	select {
+	case <-exited:
+		// Already reaped, the group may not be its any more
+		return
+	default:
+	}
+	pgid := -command.Process.Pid
+	syscall.Kill(pgid, syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(executable.killGrace):
+		log.Printf("E: %s still running after %f seconds, killing", executable.binary, executable.killGrace.Seconds())
+		syscall.Kill(pgid, syscall.SIGKILL)
+		<-exited
 	}
 }
 
@@ -68,64 +100,141 @@ func inputPipe(pipe io.WriteCloser, inputString *string, wg *sync.WaitGroup, e *
 	}()
 }
 
-func outputPipe(pipe io.ReadCloser, annotation string, wg *sync.WaitGroup, e *error) {
+func outputPipe(pipe io.ReadCloser, annotation string, wg *sync.WaitGroup, e *error, lines *tail) {
 	wg.Add(1)
 	pipeScanner := bufio.NewScanner(pipe)
 	go func() {
 		for pipeScanner.Scan() {
 			log.Printf("%s %s\n", annotation, pipeScanner.Text())
+			if lines != nil {
+				lines.add(pipeScanner.Text())
+			}
 		}
 		wg.Done()
 	}()
 }
 
-func executionHelper(binary string, executableArguments []string, messageBody *string, messageID *string) error {
+// tailLines is how much of a task's standard error ends up in its result
+const tailLines = 20
+
+// tail keeps the last tailLines lines added to it
+type tail struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (t *tail) add(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lines = append(t.lines, line)
+	if len(t.lines) > tailLines {
+		t.lines = t.lines[len(t.lines)-tailLines:]
+	}
+}
+
+func (t *tail) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.Join(t.lines, "\n")
+}
+
+func (executable *Executable) executionHelper(messageBody *string, messageID *string, attributes map[string]string, started chan<- stopper) error {
 	var exitCode int
 	var err error
 	var stdinPipe io.WriteCloser
-	var stdoutPipe io.ReadCloser
-	var stderrPipe io.ReadCloser
 
-	environ := os.Environ()
-	environ = append(environ, fmt.Sprintf("TASK_PAYLOAD=%s", *messageBody))
+	executable.result.Output = ""
+	executable.result.Stderr = ""
+	var environ []string
+	for _, env := range os.Environ() {
+		// tasque's own TASK_PAYLOAD is the env source, not necessarily this payload
+		if !strings.HasPrefix(env, "TASK_PAYLOAD=") {
+			environ = append(environ, env)
+		}
+	}
+	if executable.payload.env {
+		environ = append(environ, fmt.Sprintf("TASK_PAYLOAD=%s", *messageBody))
+	}
+	if executable.payload.file {
+		payloadFile, err := writePayloadFile(executable.payloadDir, messageBody)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(payloadFile)
+		environ = append(environ, fmt.Sprintf("TASK_PAYLOAD_FILE=%s", payloadFile))
+		attributesFile, err := writeAttributesFile(executable.payloadDir, attributes)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(attributesFile)
+		environ = append(environ, fmt.Sprintf("TASK_ATTRIBUTES_FILE=%s", attributesFile))
+	}
+	environ = append(environ, attributeEnv(executable.payload, attributes)...)
+	outputFile, err := createOutputFile(executable.payloadDir)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(outputFile)
+	environ = append(environ, fmt.Sprintf("TASK_OUTPUT_FILE=%s", outputFile))
 	environ = append(environ, fmt.Sprintf("TASK_ID=%s", *messageID))
-	command := exec.Command(binary, executableArguments...)
+	command := exec.Command(executable.binary, executable.arguments...)
 	command.Env = environ
+	// Own process group so that terminate reaches the whole process tree
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// Don't let a grandchild that left the group and holds the pipes hang Wait
+	command.WaitDelay = executable.killGrace
 
-	if messageBody != nil {
+	if executable.payload.stdin {
 		if stdinPipe, err = command.StdinPipe(); err != nil {
 			return err
 		}
 	}
-	if stdoutPipe, err = command.StdoutPipe(); err != nil {
-		return err
-	}
-	if stderrPipe, err = command.StderrPipe(); err != nil {
-		return err
-	}
+	// exec copies into these itself, so WaitDelay also covers the output
+	stdoutPipe, stdoutWriter := io.Pipe()
+	stderrPipe, stderrWriter := io.Pipe()
+	command.Stdout = stdoutWriter
+	command.Stderr = stderrWriter
 
 	if err = command.Start(); err != nil {
+		stdoutWriter.Close()
+		stderrWriter.Close()
 		return err
 	}
+	atomic.StoreInt64(&executable.pid, int64(command.Process.Pid))
+	defer atomic.StoreInt64(&executable.pid, 0)
+	started <- func(exited <-chan struct{}) { executable.terminate(command, exited) }
 
 	var wg sync.WaitGroup
-	inputPipe(stdinPipe, messageBody, &wg, &err)
-	outputPipe(stderrPipe, fmt.Sprintf("%s %s", *messageID, "ERROR"), &wg, &err)
-	outputPipe(stdoutPipe, fmt.Sprintf("%s", *messageID), &wg, &err)
+	stderr := &tail{}
+	if stdinPipe != nil {
+		inputPipe(stdinPipe, messageBody, &wg, &err)
+	}
+	outputPipe(stderrPipe, fmt.Sprintf("%s %s", *messageID, "ERROR"), &wg, &err, stderr)
+	outputPipe(stdoutPipe, fmt.Sprintf("%s", *messageID), &wg, &err, nil)
+	err = command.Wait()
+	stdoutWriter.Close()
+	stderrWriter.Close()
 	wg.Wait()
+	executable.result.Stderr = stderr.String()
+	executable.result.Output = readOutputFile(outputFile)
 	if err != nil {
-		return err
-	}
-
-	if err = command.Wait(); err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
-			exitCode = exitErr.Sys().(syscall.WaitStatus).ExitStatus()
-			log.Printf("An error occured (%s %d)\n", binary, exitCode)
+			exitCode = exitStatus(exitErr)
+			log.Printf("An error occured (%s %d)\n", executable.binary, exitCode)
 			log.Println(err)
-		} else {
-			return err
 		}
+		return err
 	}
 
 	return nil
 }
+
+// exitStatus follows the shell convention of 128+n for a process killed by
+// signal n
+func exitStatus(exitErr *exec.ExitError) int {
+	status := exitErr.Sys().(syscall.WaitStatus)
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
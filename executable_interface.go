@@ -1,9 +1,74 @@
 package main
 
-import "github.com/blaines/tasque-go/result"
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/blaines/tasque-go/result"
+)
 
 // ExecutableInterface hello world
 type ExecutableInterface interface {
-	Execute(handler MessageHandler)
+	Execute(ctx context.Context, handler MessageHandler)
 	Result() result.Result
+	clone(worker int) ExecutableInterface
+	// alive says whether the task is still running, or still starting, so
+	// that a dead one doesn't keep getting heartbeats
+	alive(ctx context.Context) bool
+}
+
+// stopper stops a task that may still be running, exited is closed once the
+// executable is done waiting for it
+type stopper func(exited <-chan struct{})
+
+// runTask runs the task until it finishes, times out or ctx is cancelled by
+// a shutdown or by a heartbeat. run sends a stopper as soon as there is
+// something to stop, classify sets the exit of a task that finished. r is
+// run's until it returns.
+func runTask(ctx context.Context, handler MessageHandler, name string, timeout time.Duration, r *result.Result, run func(ctx context.Context, started chan<- stopper) error, classify func(err error)) {
+	taskCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var err error
+	exited := make(chan struct{})
+	started := make(chan stopper, 1)
+	go func() {
+		defer close(exited)
+		err = run(taskCtx, started)
+	}()
+	select {
+	case <-exited:
+		classify(err)
+		if err != nil {
+			log.Printf("E: %s %s", name, err.Error())
+			handler.failure(ctx, *r)
+		} else {
+			log.Printf("I: %s finished successfully", name)
+			handler.success(ctx, *r)
+		}
+		return
+	case <-taskCtx.Done():
+	}
+
+	// Whatever run started mustn't be left running, run may return before
+	// the task is gone
+	select {
+	case stop := <-started:
+		stop(exited)
+	case <-exited:
+		select {
+		case stop := <-started:
+			stop(exited)
+		default:
+		}
+	}
+	<-exited
+	if ctx.Err() == nil {
+		log.Printf("E: %s timed out after %f seconds", name, timeout.Seconds())
+		r.SetExit("TIMEOUT")
+		handler.failure(ctx, *r)
+		return
+	}
+	log.Printf("E: %s interrupted", name)
+	releaseMessage(handler)
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blaines/tasque-go/result"
+)
+
+// recordingHandler is a message that keeps what the task reported
+type recordingHandler struct {
+	ENVHandler
+	mu        sync.Mutex
+	successes []result.Result
+	failures  []result.Result
+	released  int
+}
+
+func newRecordingHandler() *recordingHandler {
+	handler := &recordingHandler{ENVHandler: ENVHandler{payload: "{}"}}
+	handler.receive(context.Background())
+	return handler
+}
+
+func (handler *recordingHandler) success(ctx context.Context, r result.Result) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	handler.successes = append(handler.successes, r)
+}
+
+func (handler *recordingHandler) failure(ctx context.Context, r result.Result) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	handler.failures = append(handler.failures, r)
+}
+
+func (handler *recordingHandler) release(ctx context.Context) {
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	handler.released++
+}
+
+// gone says whether the process has exited, a zombie included
+func gone(pid int) bool {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	// The state follows the command, which is in parentheses
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return len(fields) == 0 || fields[0] == "Z"
+}
+
+func TestExecutableTimeoutKillsProcessGroup(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("needs /proc")
+	}
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	// Neither the shell nor its child give in to SIGTERM, the ignored
+	// signal is inherited
+	script := fmt.Sprintf(`trap "" TERM; sleep 30 & echo $! > %s; wait`, pidFile)
+	executable := &Executable{binary: "sh", arguments: []string{"-c", script}, timeout: 500 * time.Millisecond, killGrace: 300 * time.Millisecond}
+	handler := newRecordingHandler()
+
+	started := time.Now()
+	executable.Execute(context.Background(), handler)
+	if took := time.Since(started); took > 5*time.Second {
+		t.Errorf("took %s to time out", took)
+	}
+	if len(handler.failures) != 1 || len(handler.successes) != 0 || handler.released != 0 {
+		t.Fatalf("got %d failures, %d successes and %d releases, want one failure", len(handler.failures), len(handler.successes), handler.released)
+	}
+	if exit := handler.failures[0].Exit; exit != "TIMEOUT" {
+		t.Errorf("got exit %q, want TIMEOUT", exit)
+	}
+
+	pid, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var grandchild int
+	if _, err := fmt.Sscan(string(pid), &grandchild); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !gone(grandchild) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !gone(grandchild) {
+		t.Errorf("the task's child %d is still running", grandchild)
+	}
+}
+
+func TestExecutableExitStatus(t *testing.T) {
+	tests := []struct {
+		script  string
+		exit    string
+		success bool
+	}{
+		{"exit 0", "0", true},
+		{"exit 3", "3", false},
+		{"echo oops >&2; exit 255", "255", false},
+		{"kill -KILL $$", "137", false},
+	}
+	for _, test := range tests {
+		executable := &Executable{binary: "sh", arguments: []string{"-c", test.script}, timeout: 10 * time.Second, killGrace: time.Second}
+		handler := newRecordingHandler()
+		executable.Execute(context.Background(), handler)
+		reported := handler.failures
+		if test.success {
+			reported = handler.successes
+		}
+		if len(reported) != 1 || len(handler.successes)+len(handler.failures) != 1 {
+			t.Errorf("%s: got %d successes and %d failures", test.script, len(handler.successes), len(handler.failures))
+			continue
+		}
+		if reported[0].Exit != test.exit {
+			t.Errorf("%s: got exit %q, want %q", test.script, reported[0].Exit, test.exit)
+		}
+	}
+
+	handler := newRecordingHandler()
+	missing := &Executable{binary: filepath.Join(t.TempDir(), "missing"), timeout: 10 * time.Second, killGrace: time.Second}
+	missing.Execute(context.Background(), handler)
+	if len(handler.failures) != 1 || handler.failures[0].Exit != "UNKNOWN" {
+		t.Errorf("a missing binary got %d failures %+v, want UNKNOWN", len(handler.failures), handler.failures)
+	}
+}
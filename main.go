@@ -1,202 +1,485 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"encoding/json"
-	"github.com/aws/aws-sdk-go/aws"
+	"github.com/blaines/tasque-go/result"
+	"github.com/mitchellh/cli"
 )
 
 // Tasque hello world
 type Tasque struct {
-	Handler    MessageHandler
-	Executable ExecutableInterface
+	Source       string
+	Payload      string
+	QueueURL     string
+	ActivityARN  string
+	Handler      MessageHandler
+	Executable   ExecutableInterface
+	Daemon       bool
+	Concurrency  int
+	DrainTimeout time.Duration
+	Heartbeat    time.Duration
+	// Visibility is how far an SQS heartbeat extends the message's
+	// visibility timeout
+	Visibility time.Duration
+	RetryDelay time.Duration
+	MaxRetry   time.Duration
+	// BatchSize is the most SQS messages received at once
+	BatchSize int
+	// ResultQueueURL gets the result of every SQS message
+	ResultQueueURL string
+	// SNSCertificate verifies SNS notifications when it's set
+	SNSCertificate *x509.Certificate
+	// TaskTokenPath makes SQS messages report to Step Functions, see
+	// callbackMessage
+	TaskTokenPath string
+	// MaxAttempts is how often a message may fail before it's quarantined,
+	// 0 for no limit
+	MaxAttempts int
+	Quarantine  Quarantine
+	// AWS configures every AWS client
+	AWS *AWSConfig
+	// BlobStore holds the payloads of pointer messages
+	BlobStore BlobStore
+	// Activities replace ActivityARN and Executable when a daemon serves
+	// several Step Functions activities
+	Activities []Activity
+	// receiveCtx is cancelled when workers should stop receiving, taskCtx
+	// when in-flight tasks should be stopped and handed back
+	receiveCtx    context.Context
+	stopReceiving context.CancelFunc
+	taskCtx       context.Context
+	stopTasks     context.CancelFunc
+}
+
+// Activity is one of several Step Functions activities, with an executable
+// and a concurrency of its own
+type Activity struct {
+	ARN         string
+	Concurrency int
+	Executable  ExecutableInterface
 }
 
 // Support three modes of operation
 // -e environment variable TASK_PAYLOAD
 // -i standard input
 // -f file output
-// TODO:
-// func main() {
-// 	c := cli.NewCLI("app", "1.0.0")
-// 	c.Args = os.Args[1:]
-// 	c.Commands = map[string]cli.CommandFactory{
-// 	// "foo": fooCommandFactory,
-// 	// "bar": barCommandFactory,
-// 	}
-//
-// 	exitStatus, err := c.Run()
-// 	if err != nil {
-// 		log.Println(err)
-// 	}
-//
-// 	os.Exit(exitStatus)
-// }
-
 func main() {
-	var taskDefinition *string
-	var overridePayloadKey *string
-	var dockerPayloadKey string
-	var overrideContainerName *string
-	var dockerEndpointPath string
-	var deployMethod *string
-
-	isDocker := os.Getenv("DOCKER")
-	if isDocker != "" {
-		log.Println("Docker mode")
-		// Docker Mode
-		tasque := Tasque{}
-		// DEPLOY_METHOD:  Curerntly it's ECS by default can be switched to DOCKER
-		deployMethod = aws.String(os.Getenv("DEPLOY_METHOD"))
-		if *deployMethod == "" {
-			*deployMethod = "ECS"
-		}
-		if *deployMethod == "DOCKER" {
-			// DOCKER_CONTAINER_NAME
-			overrideContainerName = aws.String(os.Getenv("DOCKER_CONTAINER_NAME"))
-			if *overrideContainerName == "" {
-				panic("Environment variable DOCKER_CONTAINER_NAME not set")
-			}
-			// DOCKER_TASK_DEFINITION
-			taskDefinition = aws.String(os.Getenv("DOCKER_TASK_DEFINITION"))
-			if *taskDefinition == "" {
-				panic("Environment variable DOCKER_TASK_DEFINITION not set")
-			}
+	c := cli.NewCLI("tasque", Version)
+	c.Args = legacyArgs(os.Args[1:])
+	c.Commands = commands
 
-			// DOCKER_ENDPOINT
-			dockerEndpointPath = os.Getenv("DOCKER_ENDPOINT")
-			if dockerEndpointPath == "" {
-				dockerEndpointPath = "unix:///var/run/docker.sock"
-			}
-			// OVERRIDE_PAYLOAD_KEY
-			dockerPayloadKey = os.Getenv("TASK_PAYLOAD")
+	exitStatus, err := c.Run()
+	if err != nil {
+		log.Println(err)
+	}
 
-			overrideTaskDefinition := DockerTaskDefinition{}
-			json.Unmarshal([]byte(*taskDefinition), &overrideTaskDefinition)
+	os.Exit(exitStatus)
+}
 
-			d := &AWSDOCKER{
-				containerName:        *overrideContainerName,
-				timeout:              getTimeout(),
-				containerArgs:        dockerPayloadKey,
-				dockerTaskDefinition: overrideTaskDefinition,
-			}
-			d.connect(dockerEndpointPath)
-			tasque.Executable = d
-			tasque.runWithTimeout()
-		} else {
-			// ECS_TASK_DEFINITION
-			taskDefinition = aws.String(os.Getenv("ECS_TASK_DEFINITION"))
-			if *taskDefinition == "" {
-				panic("Environment variable ECS_TASK_DEFINITION not set")
-			}
-			// ECS_CONTAINER_NAME
-			overrideContainerName = aws.String(os.Getenv("ECS_CONTAINER_NAME"))
-			if *overrideContainerName == "" {
-				panic("Environment variable ECS_CONTAINER_NAME not set")
-			}
-			// DOCKER_ENDPOINT
-			dockerEndpointPath = os.Getenv("DOCKER_ENDPOINT")
-			if dockerEndpointPath == "" {
-				dockerEndpointPath = "unix:///var/run/docker.sock"
-			}
-			// OVERRIDE_PAYLOAD_KEY
-			overridePayloadKey = aws.String("TASK_PAYLOAD")
-			// DEPLOY_METHOD:  Curerntly it's ECS by default can be switched to DOCKER
-			d := &Docker{}
-			d.connect(dockerEndpointPath)
-			tasque.Executable = &AWSECS{
-				docker:                d,
-				ecsTaskDefinition:     taskDefinition,
-				overrideContainerName: overrideContainerName,
-				overridePayloadKey:    overridePayloadKey,
-				timeout:               getTimeout(),
-			}
-			tasque.runWithTimeout()
-		}
-	} else {
-		// CLI Mode
-		arguments := os.Args[1:]
-		if len(os.Args) > 1 {
-			tasque := Tasque{}
-			tasque.Executable = &Executable{
-				binary:    arguments[0],
-				arguments: arguments[1:],
-				timeout:   getTimeout(),
+var commands = map[string]cli.CommandFactory{
+	"exec": func() (cli.Command, error) {
+		return &ExecCommand{}, nil
+	},
+	"docker": func() (cli.Command, error) {
+		return &DockerCommand{}, nil
+	},
+	"ecs": func() (cli.Command, error) {
+		return &ECSCommand{}, nil
+	},
+	"config validate": func() (cli.Command, error) {
+		return &ConfigValidateCommand{}, nil
+	},
+	"version": func() (cli.Command, error) {
+		return &VersionCommand{}, nil
+	},
+}
+
+// legacyArgs maps the environment variable driven invocation of earlier
+// releases (DOCKER, DEPLOY_METHOD, "tasque npm start") onto a subcommand
+func legacyArgs(args []string) []string {
+	if len(args) > 0 {
+		if strings.HasPrefix(args[0], "-") {
+			return args
+		}
+		for name := range commands {
+			if strings.SplitN(name, " ", 2)[0] == args[0] {
+				return args
 			}
-			tasque.runWithTimeout()
-		} else {
-			log.Println("Expecting tasque to be run with an application")
-			log.Println("Usage: tasque npm start")
 		}
 	}
+	if os.Getenv("DOCKER") != "" {
+		log.Println("DOCKER is deprecated, use the docker or ecs command")
+		if os.Getenv("DEPLOY_METHOD") == "DOCKER" {
+			return append([]string{"docker"}, args...)
+		}
+		return append([]string{"ecs"}, args...)
+	}
+	if len(args) > 0 {
+		log.Println("Running without a command is deprecated, use tasque exec -- " + args[0])
+		return append([]string{"exec", "--"}, args...)
+	}
+	return args
 }
 
 func (tasque *Tasque) getHandler() {
+	tasque.Handler = tasque.newHandler()
+}
+
+func (tasque *Tasque) newHandler() MessageHandler {
 	var handler MessageHandler
-	taskPayload := os.Getenv("TASK_PAYLOAD")
-	taskQueueURL := os.Getenv("TASK_QUEUE_URL")
-	activityARN := os.Getenv("TASK_ACTIVITY_ARN")
-	if taskPayload != "" {
-		handler = &ENVHandler{}
-	} else if taskQueueURL != "" {
-		handler = &SQSHandler{}
-	} else if activityARN != "" {
+	switch tasque.Source {
+	case "env":
+		handler = &ENVHandler{
+			payload: tasque.Payload,
+		}
+	case "sqs":
+		handler = &SQSHandler{
+			queueURL:          tasque.QueueURL,
+			aws:               tasque.AWS,
+			visibilityTimeout: int64(tasque.Visibility.Seconds()),
+			retryDelay:        tasque.RetryDelay,
+			maxRetryDelay:     tasque.MaxRetry,
+			batchSize:         tasque.BatchSize,
+			resultQueueURL:    tasque.ResultQueueURL,
+			snsCertificate:    tasque.SNSCertificate,
+			taskTokenPath:     tasque.TaskTokenPath,
+		}
+	case "sfn":
 		handler = &SFNHandler{
-			activityARN: activityARN,
+			activityARN: tasque.ActivityARN,
+			aws:         tasque.AWS,
 		}
-	} else {
+	default:
 		panic("No handler")
 	}
-	tasque.Handler = handler
+	return handler
 }
 
 func (tasque *Tasque) runWithTimeout() {
 	tasque.getHandler()
-	// Commented code is for potential future "daemon"
-	// var wg sync.WaitGroup
-	// for i := 0; i < 5; i++ {
-	// 	wg.Add(1)
-	// 	go func() {
-	// 		defer wg.Done()
-	// 		for i := 0; i < 5; i++ {
-	tasque.Executable.Execute(tasque.Handler)
-	// 		}
-	// 	}()
-	// }
-	// wg.Wait()
-}
-
-func getTimeout() time.Duration {
-	taskTimeout := os.Getenv("TASK_TIMEOUT")
-	if taskTimeout == "" {
-		log.Println("Default timeout: 30s")
-		timeout, _ := time.ParseDuration("30s")
-		return timeout
-	}
-	timeout, err := time.ParseDuration(taskTimeout)
-	if err != nil {
-		log.Println(err.Error())
-		os.Exit(1)
-		return time.Duration(0)
+	tasque.receiveCtx, tasque.stopReceiving = context.WithCancel(context.Background())
+	tasque.taskCtx, tasque.stopTasks = context.WithCancel(context.Background())
+	defer tasque.stopReceiving()
+	defer tasque.stopTasks()
+	if acks, ok := tasque.Handler.(acknowledger); ok {
+		defer acks.flush()
+	}
+
+	done := make(chan struct{})
+	if tasque.Source == "env" && tasque.Daemon {
+		// TASK_PAYLOAD is a single message, there is nothing to loop over
+		log.Println("TASK_PAYLOAD is set, running once instead of as a daemon")
+		tasque.Daemon = false
+	}
+	if !tasque.Daemon {
+		go func() {
+			defer close(done)
+			tasque.Handler.initialize()
+			if tasque.Handler.receive(tasque.receiveCtx) {
+				tasque.execute(tasque.Handler, tasque.Executable)
+			}
+		}()
+		tasque.wait(done)
+		return
+	}
+
+	if len(tasque.Activities) > 0 {
+		log.Printf("Daemon mode serving %d activities", len(tasque.Activities))
+		var wg sync.WaitGroup
+		worker := 0
+		for _, activity := range tasque.Activities {
+			wg.Add(1)
+			go func(activity Activity, first int) {
+				defer wg.Done()
+				tasque.workActivity(activity, first)
+			}(activity, worker)
+			worker += activity.Concurrency
+		}
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		tasque.wait(done)
+		return
+	}
+
+	if receiver, ok := tasque.Handler.(batchReceiver); ok {
+		log.Printf("Daemon mode running up to %d tasks", tasque.Concurrency)
+		go func() {
+			defer close(done)
+			tasque.Handler.initialize()
+			tasque.workBatches(receiver)
+		}()
+		tasque.wait(done)
+		return
 	}
-	return timeout
+
+	log.Printf("Daemon mode with %d workers", tasque.Concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < tasque.Concurrency; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			tasque.work(worker)
+		}(i)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	tasque.wait(done)
 }
 
-func getHeartbeatTime() time.Duration {
-	taskTimeout := os.Getenv("TASK_HEARTBEAT")
-	if taskTimeout == "" {
-		log.Println("Default timeout: 30s")
-		timeout, _ := time.ParseDuration("30s")
-		return timeout
+// wait blocks until done is closed. On SIGTERM or SIGINT the workers stop
+// receiving and in-flight tasks get the drain window to finish, after which
+// they are stopped and their messages handed back.
+func (tasque *Tasque) wait(done <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	select {
+	case <-done:
+		return
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down", sig)
+		tasque.Stop()
 	}
-	timeout, err := time.ParseDuration(taskTimeout)
+
+	select {
+	case <-done:
+		log.Println("All tasks drained")
+	case <-time.After(tasque.DrainTimeout):
+		log.Printf("Tasks still running after %f seconds, stopping them", tasque.DrainTimeout.Seconds())
+		tasque.stopTasks()
+		<-done
+	}
+}
+
+// work keeps receiving and executing messages until the daemon is stopped.
+// Each worker owns its handler and its copy of the executable.
+func (tasque *Tasque) work(worker int) {
+	handler := tasque.newHandler()
+	executable := tasque.Executable.clone(worker)
+	handler.initialize()
+	for tasque.receiveCtx.Err() == nil {
+		if handler.receive(tasque.receiveCtx) {
+			tasque.execute(handler, executable)
+		}
+	}
+	log.Printf("Worker %d stopped", worker)
+}
+
+// workBatches receives as many messages as there are idle executables and
+// runs each of them concurrently, until the daemon is stopped
+func (tasque *Tasque) workBatches(receiver batchReceiver) {
+	idle := make(chan ExecutableInterface, tasque.Concurrency)
+	for i := 0; i < tasque.Concurrency; i++ {
+		idle <- tasque.Executable.clone(i)
+	}
+	var wg sync.WaitGroup
+	failures := 0
+	for tasque.receiveCtx.Err() == nil {
+		var executables []ExecutableInterface
+		select {
+		case executable := <-idle:
+			executables = append(executables, executable)
+		case <-tasque.receiveCtx.Done():
+			continue
+		}
+	idleLoop:
+		for {
+			select {
+			case executable := <-idle:
+				executables = append(executables, executable)
+			default:
+				break idleLoop
+			}
+		}
+
+		received, err := receiver.receiveBatch(tasque.receiveCtx, len(executables))
+		if err != nil {
+			for _, executable := range executables {
+				idle <- executable
+			}
+			// The same backoff as polling Step Functions
+			failures++
+			delay := sfnPollDelay(failures)
+			log.Printf("E: Receiving failed %d times in a row, retrying in %s %s", failures, delay, err)
+			select {
+			case <-tasque.receiveCtx.Done():
+			case <-time.After(delay):
+			}
+			continue
+		}
+		failures = 0
+		groups := groupMessages(received)
+		for i, messages := range groups {
+			wg.Add(1)
+			go func(messages []MessageHandler, executable ExecutableInterface) {
+				defer wg.Done()
+				tasque.executeInOrder(messages, executable)
+				idle <- executable
+			}(messages, executables[i])
+		}
+		for _, executable := range executables[len(groups):] {
+			idle <- executable
+		}
+	}
+	wg.Wait()
+	log.Println("Stopped receiving")
+}
+
+// activityWorker is a handler and executable that serve one activity task
+// at a time
+type activityWorker struct {
+	handler    MessageHandler
+	executable ExecutableInterface
+}
+
+// workActivity polls the activity whenever one of its workers is idle, until
+// the daemon is stopped. Every activity polls on its own, with at most one
+// poll open, so a busy activity never holds back the others. Workers are
+// numbered from first.
+func (tasque *Tasque) workActivity(activity Activity, first int) {
+	idle := make(chan activityWorker, activity.Concurrency)
+	for i := 0; i < activity.Concurrency; i++ {
+		handler := &SFNHandler{
+			activityARN: activity.ARN,
+			aws:         tasque.AWS,
+		}
+		handler.initialize()
+		idle <- activityWorker{handler, activity.Executable.clone(first + i)}
+	}
+	var wg sync.WaitGroup
+	for tasque.receiveCtx.Err() == nil {
+		var worker activityWorker
+		select {
+		case worker = <-idle:
+		case <-tasque.receiveCtx.Done():
+			continue
+		}
+		if !worker.handler.receive(tasque.receiveCtx) {
+			idle <- worker
+			continue
+		}
+		wg.Add(1)
+		go func(worker activityWorker) {
+			defer wg.Done()
+			tasque.execute(worker.handler, worker.executable)
+			idle <- worker
+		}(worker)
+	}
+	wg.Wait()
+	log.Printf("Stopped polling %s", activity.ARN)
+}
+
+// groupMessages keeps messages of the same ordered group together, in the
+// order they were received. Every other message is a group of its own.
+func groupMessages(messages []MessageHandler) [][]MessageHandler {
+	var groups [][]MessageHandler
+	index := map[string]int{}
+	for _, message := range messages {
+		if ordered, ok := message.(orderedMessage); ok && ordered.group() != "" {
+			if i, ok := index[ordered.group()]; ok {
+				groups[i] = append(groups[i], message)
+				continue
+			}
+			index[ordered.group()] = len(groups)
+		}
+		groups = append(groups, []MessageHandler{message})
+	}
+	return groups
+}
+
+// executeInOrder runs the messages of a group one after the other, the ones
+// still waiting get heartbeats too. A failure holds back the rest of the
+// group until their visibility runs out, a shutdown releases them.
+func (tasque *Tasque) executeInOrder(messages []MessageHandler, executable ExecutableInterface) {
+	for i, message := range messages {
+		waiting := messages[i+1:]
+		ctx, cancel := context.WithCancel(tasque.taskCtx)
+		go tasque.heartbeat(ctx, nil, nil, waiting...)
+		tasque.execute(message, executable)
+		cancel()
+		if len(waiting) == 0 {
+			return
+		}
+		if tasque.taskCtx.Err() != nil {
+			for _, message := range waiting {
+				releaseMessage(message)
+			}
+			return
+		}
+		if ordered, ok := message.(orderedMessage); ok && !ordered.succeeded() {
+			log.Printf("Holding back %d messages of group %s after %s", len(waiting), ordered.group(), *message.id())
+			return
+		}
+	}
+}
+
+// execute runs one task and heartbeats on its handler every Heartbeat until
+// the task is done, or until the handler's source gives up on it
+func (tasque *Tasque) execute(handler MessageHandler, executable ExecutableInterface) {
+	ctx, cancel := context.WithCancel(tasque.taskCtx)
+	defer cancel()
+	go tasque.heartbeat(ctx, cancel, executable, handler)
+	handler = timed(tasque.quarantining(handler))
+	payload, err := resolvePayload(ctx, tasque.BlobStore, *handler.body())
 	if err != nil {
-		log.Println(err.Error())
-		os.Exit(1)
-		return time.Duration(0)
+		log.Printf("E: %s", err)
+		r := result.New()
+		r.SetExit("PAYLOAD")
+		handler.failure(ctx, r)
+		return
+	}
+	if payload != *handler.body() {
+		handler = &resolvedMessage{MessageHandler: handler, payload: payload}
+	}
+	executable.Execute(ctx, handler)
+}
+
+// heartbeat heartbeats on the handlers every Heartbeat until ctx is done.
+// The executable, if any, has to be alive for the heartbeat to be sent, a
+// task that died without tasque noticing is left to time out. A handler
+// whose source gave up on its message has the task stopped with stop.
+func (tasque *Tasque) heartbeat(ctx context.Context, stop context.CancelFunc, executable ExecutableInterface, handlers ...MessageHandler) {
+	if len(handlers) == 0 {
+		return
 	}
-	return timeout
+	ticker := time.NewTicker(tasque.Heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			if executable != nil && !executable.alive(ctx) {
+				log.Println("Task is not running, skipping heartbeat", t)
+				continue
+			}
+			for _, handler := range handlers {
+				if err := handler.heartbeat(ctx); err == errAbandoned && stop != nil {
+					log.Printf("E: %s %s, stopping it", *handler.id(), err)
+					stop()
+					return
+				}
+			}
+			log.Println("Heartbeat", t)
+		}
+	}
+}
+
+// Stop tells workers not to pick up new messages.
+func (tasque *Tasque) Stop() {
+	tasque.stopReceiving()
 }
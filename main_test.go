@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestGroupMessages(t *testing.T) {
+	message := func(id string, group string) MessageHandler {
+		attributes := map[string]string{}
+		if group != "" {
+			attributes[sqs.MessageSystemAttributeNameMessageGroupId] = group
+		}
+		return &SQSMessage{messageID: id, messageAttributes: attributes}
+	}
+	messages := []MessageHandler{
+		message("a1", "a"),
+		message("x", ""),
+		message("b1", "b"),
+		message("a2", "a"),
+		&SFNHandler{taskToken: "sfn-task-token-that-is-long-enough-to-have-an-id"},
+		message("b2", "b"),
+		message("a3", "a"),
+		message("y", ""),
+	}
+	var got [][]string
+	for _, group := range groupMessages(messages) {
+		var ids []string
+		for _, message := range group {
+			ids = append(ids, *message.id())
+		}
+		got = append(got, ids)
+	}
+	want := [][]string{
+		{"a1", "a2", "a3"},
+		{"x"},
+		{"b1", "b2"},
+		{"sfn-task-token-that-is-long-enou"},
+		{"y"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if groups := groupMessages(nil); len(groups) != 0 {
+		t.Errorf("got %d groups for no messages", len(groups))
+	}
+}
+
+func TestShutdownReleasesMessages(t *testing.T) {
+	message := func(id string, group string) *sqs.Message {
+		m := &sqs.Message{MessageId: aws.String(id), ReceiptHandle: aws.String(id), Body: aws.String("{}")}
+		if group != "" {
+			m.Attributes = map[string]*string{sqs.MessageSystemAttributeNameMessageGroupId: aws.String(group)}
+		}
+		return m
+	}
+	fake := &fakeSQS{queued: []*sqs.Message{message("a", ""), message("b", ""), message("c1", "c"), message("c2", "c")}}
+	handler := newFakeSQSHandler(fake)
+	tasque := &Tasque{
+		Handler:     handler,
+		Executable:  &Executable{binary: "sh", arguments: []string{"-c", "sleep 30"}, timeout: time.Minute, killGrace: time.Second},
+		Concurrency: 4,
+		Heartbeat:   time.Minute,
+	}
+	tasque.receiveCtx, tasque.stopReceiving = context.WithCancel(context.Background())
+	tasque.taskCtx, tasque.stopTasks = context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tasque.workBatches(handler)
+	}()
+	for fake.pending() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	tasque.Stop()
+	tasque.stopTasks()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("tasks weren't stopped")
+	}
+	// c2 never started, it's released with the task holding it back
+	for _, handle := range []string{"a", "b", "c1", "c2"} {
+		if got := fake.visibilities(handle); !reflect.DeepEqual(got, []int64{0}) {
+			t.Errorf("%s: got visibility changes %v, want it released", handle, got)
+		}
+	}
+	if deletes := fake.deletes(); len(deletes) != 0 {
+		t.Errorf("deleted %q", deletes)
+	}
+}
@@ -1,14 +1,96 @@
 package main
 
-import "github.com/blaines/tasque-go/result"
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/blaines/tasque-go/result"
+)
+
+// errAbandoned means the task should be stopped, there is no one left to
+// report its result to
+var errAbandoned = errors.New("The message's source gave up on it")
+
+// releaseTimeout bounds how long handing a message back may take
+const releaseTimeout = 10 * time.Second
 
 // MessageHandler hello world
 type MessageHandler interface {
 	id() *string
 	body() *string
+	// attributes are the message's metadata besides the body, if the
+	// source has any
+	attributes() map[string]string
 	initialize()
-	receive() bool
-	success()
-	failure(err result.Result)
-	heartbeat()
+	receive(ctx context.Context) bool
+	success(ctx context.Context, result result.Result)
+	failure(ctx context.Context, err result.Result)
+	// heartbeat returns errAbandoned once the source has given up on the
+	// message, other errors are only logged
+	heartbeat(ctx context.Context) error
+	release(ctx context.Context)
+	// discard gives up on a message for good, see Quarantine
+	discard(ctx context.Context, err result.Result)
+}
+
+// batchReceiver is a MessageHandler that can receive several messages at
+// once, each with a MessageHandler of its own. The error says the receive
+// itself failed, as opposed to there being no messages.
+type batchReceiver interface {
+	receiveBatch(ctx context.Context, max int) ([]MessageHandler, error)
+}
+
+// acknowledger is a MessageHandler that finishes off messages in the
+// background, flush waits for that before tasque exits
+type acknowledger interface {
+	flush()
+}
+
+// orderedMessage is a message that has to finish before the next one of its
+// group may start, e.g. from an SQS FIFO queue
+type orderedMessage interface {
+	group() string
+	// succeeded says whether the message is done with for good
+	succeeded() bool
+}
+
+// releaseMessage hands the message back on a fresh context, the task's own
+// context has already been cancelled by the time this is needed.
+func releaseMessage(handler MessageHandler) {
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	handler.release(ctx)
+}
+
+// timedHandler stamps every result with when the task ran and, where the
+// source counts them, which attempt it was
+type timedHandler struct {
+	MessageHandler
+	started time.Time
+}
+
+func timed(handler MessageHandler) MessageHandler {
+	return &timedHandler{MessageHandler: handler, started: time.Now()}
+}
+
+func (handler *timedHandler) stamp(r result.Result) result.Result {
+	r.Started = handler.started
+	r.Finished = time.Now()
+	if counted, ok := handler.MessageHandler.(countedMessage); ok {
+		r.Attempt = counted.attempts()
+	}
+	return r
+}
+
+func (handler *timedHandler) success(ctx context.Context, r result.Result) {
+	handler.MessageHandler.success(ctx, handler.stamp(r))
+}
+
+func (handler *timedHandler) failure(ctx context.Context, r result.Result) {
+	handler.MessageHandler.failure(ctx, handler.stamp(r))
+}
+
+func (handler *timedHandler) discard(ctx context.Context, r result.Result) {
+	handler.MessageHandler.discard(ctx, handler.stamp(r))
 }
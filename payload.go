@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// payloadMode is how a task receives its payload: the TASK_PAYLOAD
+// environment variable, standard input and/or a file named by
+// TASK_PAYLOAD_FILE
+type payloadMode struct {
+	env   bool
+	stdin bool
+	file  bool
+}
+
+func parsePayloadMode(mode string) (payloadMode, error) {
+	switch mode {
+	case "env":
+		return payloadMode{env: true}, nil
+	case "stdin":
+		return payloadMode{stdin: true}, nil
+	case "file":
+		return payloadMode{file: true}, nil
+	case "all", "":
+		return payloadMode{env: true, stdin: true, file: true}, nil
+	}
+	return payloadMode{}, fmt.Errorf("Unknown payload mode %q, expecting env, stdin, file or all", mode)
+}
+
+var attributeNameInvalid = regexp.MustCompile("[^A-Z0-9_]")
+
+// attributeEnv names each attribute TASK_ATTR_<NAME>, upper case with
+// anything that can't be in a variable name replaced by _, e.g.
+// MessageGroupId is TASK_ATTR_MESSAGEGROUPID. A task that only reads files
+// gets TASK_ATTRIBUTES_FILE instead. Messages from FIFO queues always set
+// TASK_GROUP_ID and TASK_DEDUPLICATION_ID, ones from SNS TASK_TOPIC_ARN.
+func attributeEnv(mode payloadMode, attributes map[string]string) []string {
+	var env []string
+	if mode.env || mode.stdin {
+		for name, value := range attributes {
+			name = attributeNameInvalid.ReplaceAllString(strings.ToUpper(name), "_")
+			env = append(env, fmt.Sprintf("TASK_ATTR_%s=%s", name, value))
+		}
+		sort.Strings(env)
+	}
+	if group, ok := attributes["MessageGroupId"]; ok {
+		env = append(env, fmt.Sprintf("TASK_GROUP_ID=%s", group))
+	}
+	if deduplicationID, ok := attributes["MessageDeduplicationId"]; ok {
+		env = append(env, fmt.Sprintf("TASK_DEDUPLICATION_ID=%s", deduplicationID))
+	}
+	if topicArn, ok := attributes["TopicArn"]; ok {
+		env = append(env, fmt.Sprintf("TASK_TOPIC_ARN=%s", topicArn))
+	}
+	return env
+}
+
+func attributesJSON(attributes map[string]string) []byte {
+	if attributes == nil {
+		attributes = map[string]string{}
+	}
+	data, _ := json.Marshal(attributes)
+	return data
+}
+
+// writeAttributesFile writes the attributes as a JSON object to a file of its
+// own in dir, which the caller removes once the task is done
+func writeAttributesFile(dir string, attributes map[string]string) (string, error) {
+	file, err := ioutil.TempFile(dir, "tasque-attributes-")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if err := file.Chmod(0644); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	if _, err := file.Write(attributesJSON(attributes)); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// writePayloadFile writes the payload to a file of its own in dir, which the
+// caller removes once the task is done
+func writePayloadFile(dir string, messageBody *string) (string, error) {
+	file, err := ioutil.TempFile(dir, "tasque-payload-")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if err := file.Chmod(0644); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	if _, err := file.WriteString(*messageBody); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// createOutputFile creates the empty file a task may write its output to,
+// named by TASK_OUTPUT_FILE. The caller removes it once the task is done.
+func createOutputFile(dir string) (string, error) {
+	file, err := ioutil.TempFile(dir, "tasque-output-")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	// The task may run as a different user, e.g. in an ECS container
+	if err := file.Chmod(0666); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+func readOutputFile(path string) string {
+	output, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("Couldn't read task output %s", err)
+		return ""
+	}
+	return string(output)
+}
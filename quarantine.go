@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/blaines/tasque-go/result"
+)
+
+// Quarantine keeps messages that failed too often, for someone to look at
+type Quarantine interface {
+	put(ctx context.Context, record quarantineRecord) error
+}
+
+// quarantineRecord is a quarantined message with its last result
+type quarantineRecord struct {
+	MessageID  string            `json:"messageId"`
+	Body       string            `json:"body"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Attempts   int               `json:"attempts"`
+	Exit       string            `json:"exit"`
+	Error      string            `json:"error"`
+	Message    string            `json:"message"`
+	Output     string            `json:"output,omitempty"`
+	Stderr     string            `json:"stderr,omitempty"`
+}
+
+// DirQuarantine writes a JSON file per message
+type DirQuarantine struct {
+	dir string
+}
+
+// SQSQuarantine sends the message's body on to another queue, with the last
+// result as message attributes
+type SQSQuarantine struct {
+	client   sqsiface.SQSAPI
+	queueURL string
+}
+
+// newQuarantine builds the destination named by TASK_QUARANTINE: an SQS queue
+// URL, sfn to only report a permanent failure, or else a directory
+func newQuarantine(destination string, awsConfig *AWSConfig) (Quarantine, error) {
+	switch {
+	case destination == "" || destination == "sfn":
+		return nil, nil
+	case strings.HasPrefix(destination, "https://") || strings.HasPrefix(destination, "http://"):
+		sess, err := awsConfig.session()
+		if err != nil {
+			return nil, err
+		}
+		client := sqs.New(sess, awsConfig.clientConfig(awsConfig.SQSEndpoint, ""))
+		return &SQSQuarantine{client: client, queueURL: destination}, nil
+	}
+	return &DirQuarantine{dir: destination}, nil
+}
+
+var unsafeFileName = regexp.MustCompile("[^A-Za-z0-9._-]")
+
+func (quarantine *DirQuarantine) put(ctx context.Context, record quarantineRecord) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.json", time.Now().UTC().Format("20060102T150405Z"), unsafeFileName.ReplaceAllString(record.MessageID, "_"))
+	return ioutil.WriteFile(filepath.Join(quarantine.dir, name), data, 0644)
+}
+
+func (quarantine *SQSQuarantine) put(ctx context.Context, record quarantineRecord) error {
+	attributes := map[string]*sqs.MessageAttributeValue{}
+	for name, value := range map[string]string{
+		"TasqueMessageId": record.MessageID,
+		"TasqueAttempts":  strconv.Itoa(record.Attempts),
+		"TasqueExit":      record.Exit,
+		"TasqueError":     record.Error,
+		"TasqueStderr":    record.Stderr,
+	} {
+		// SQS doesn't take empty attributes
+		if value != "" {
+			attributes[name] = &sqs.MessageAttributeValue{
+				DataType:    aws.String("String"),
+				StringValue: aws.String(value),
+			}
+		}
+	}
+	sendMessageParams := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(quarantine.queueURL),
+		MessageBody:       aws.String(record.Body),
+		MessageAttributes: attributes,
+	}
+	fifoSend(sendMessageParams, record.Attributes[sqs.MessageSystemAttributeNameMessageGroupId], record.MessageID, record.MessageID)
+	_, sendMessageError := quarantine.client.SendMessageWithContext(ctx, sendMessageParams)
+	return sendMessageError
+}
+
+// countedMessage is a message whose source counts its deliveries, e.g. SQS
+type countedMessage interface {
+	attempts() int
+}
+
+// quarantiningHandler quarantines and discards a message once it has failed
+// MaxAttempts times, instead of failing it once more
+type quarantiningHandler struct {
+	MessageHandler
+	tasque *Tasque
+	// payload is the body as received, before a payload pointer is resolved
+	payload string
+}
+
+func (tasque *Tasque) quarantining(handler MessageHandler) MessageHandler {
+	// Only the source can tell deliveries of one message apart, e.g. two
+	// Step Functions executions may have the same input
+	if _, ok := handler.(countedMessage); !ok || tasque.MaxAttempts == 0 {
+		return handler
+	}
+	return &quarantiningHandler{MessageHandler: handler, tasque: tasque, payload: *handler.body()}
+}
+
+func (handler *quarantiningHandler) failure(ctx context.Context, r result.Result) {
+	attempts := handler.MessageHandler.(countedMessage).attempts()
+	r.Attempt = attempts
+	if attempts < handler.tasque.MaxAttempts {
+		handler.MessageHandler.failure(ctx, r)
+		return
+	}
+
+	log.Printf("E: %s failed %d times, quarantining it", *handler.id(), attempts)
+	if handler.tasque.Quarantine != nil {
+		record := quarantineRecord{
+			MessageID:  *handler.id(),
+			Body:       handler.payload,
+			Attributes: handler.attributes(),
+			Attempts:   attempts,
+			Exit:       r.Exit,
+			Error:      r.Error,
+			Message:    r.Message(),
+			Output:     r.Output,
+			Stderr:     r.Stderr,
+		}
+		if err := handler.tasque.Quarantine.put(ctx, record); err != nil {
+			// Better to fail once more than to lose the message
+			log.Printf("Couldn't quarantine %s %s", *handler.id(), err)
+			handler.MessageHandler.failure(ctx, r)
+			return
+		}
+	}
+	handler.discard(ctx, r)
+}
@@ -2,15 +2,39 @@ package result
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"os"
+	"time"
+	"unicode/utf8"
 )
 
 type Result struct {
-	Exit  string
-	Error string
-	host  string
+	Exit   string
+	Error  string
+	Output string
+	// Stderr is the end of what the task wrote to standard error
+	Stderr string
+	// Started and Finished bound the task's execution
+	Started  time.Time
+	Finished time.Time
+	// Attempt counts the executions of the message, 0 when unknown
+	Attempt int
+	host    string
+}
+
+// cause is the structured form of Cause
+type cause struct {
+	Exit      string    `json:"exit"`
+	Error     string    `json:"error"`
+	Host      string    `json:"host"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Duration  string    `json:"duration"`
+	Attempt   int       `json:"attempt,omitempty"`
+	Stderr    string    `json:"stderr,omitempty"`
+	Truncated bool      `json:"truncated,omitempty"`
 }
 
 func New() Result {
@@ -48,3 +72,67 @@ func (r *Result) Message() string {
 	t.Execute(&tpl, s)
 	return tpl.String()
 }
+
+// Cause describes a failure in at most limit bytes, as JSON unless
+// ERROR_MESSAGE_TEMPLATE asks for text. The oldest stderr lines go first
+// when it's too long.
+func (r *Result) Cause(limit int) string {
+	if os.Getenv("ERROR_MESSAGE_TEMPLATE") != "" {
+		return truncate(r.Message(), limit)
+	}
+	if r.host == "" {
+		r.host, _ = os.Hostname()
+	}
+	c := cause{
+		Exit:     r.Exit,
+		Error:    r.Error,
+		Host:     r.host,
+		Started:  r.Started,
+		Finished: r.Finished,
+		Duration: r.Finished.Sub(r.Started).String(),
+		Attempt:  r.Attempt,
+		Stderr:   r.Stderr,
+	}
+	for {
+		data, _ := json.Marshal(c)
+		if len(data) <= limit {
+			return string(data)
+		}
+		if c.Stderr == "" {
+			return truncate(string(data), limit)
+		}
+		// Escaping makes the JSON longer than the text it holds, cut
+		// in proportion
+		escaped, _ := json.Marshal(c.Stderr)
+		excess := (len(data)-limit)*len(c.Stderr)/len(escaped) + 1
+		c.Stderr = truncateFront(c.Stderr, len(c.Stderr)-excess)
+		c.Truncated = true
+	}
+}
+
+// truncate keeps the first limit bytes of s, without splitting a character
+func truncate(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	for limit > 0 && !utf8.RuneStart(s[limit]) {
+		limit--
+	}
+	return s[:limit]
+}
+
+// truncateFront keeps the last limit bytes of s, without splitting a
+// character
+func truncateFront(s string, limit int) string {
+	if limit <= 0 {
+		return ""
+	}
+	if len(s) <= limit {
+		return s
+	}
+	start := len(s) - limit
+	for start < len(s) && !utf8.RuneStart(s[start]) {
+		start++
+	}
+	return s[start:]
+}
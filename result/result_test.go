@@ -0,0 +1,96 @@
+package result
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestCauseTruncatesStderr(t *testing.T) {
+	// Every line is multibyte and some need escaping in JSON
+	var lines []string
+	for i := 0; i < 500; i++ {
+		lines = append(lines, "ошибка \"日本語\" 🙂 line")
+	}
+	lines = append(lines, "the last line")
+	r := New()
+	r.SetHost("host")
+	r.SetExit("1")
+	r.Started = time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	r.Finished = r.Started.Add(time.Minute)
+	r.Stderr = strings.Join(lines, "\n")
+
+	for _, limit := range []int{300, 1000, 4096, 32768} {
+		cause := r.Cause(limit)
+		if len(cause) > limit {
+			t.Errorf("limit %d: cause is %d bytes", limit, len(cause))
+		}
+		if !utf8.ValidString(cause) {
+			t.Errorf("limit %d: cause isn't valid UTF-8", limit)
+		}
+		var c struct {
+			Exit      string
+			Stderr    string
+			Truncated bool
+		}
+		if err := json.Unmarshal([]byte(cause), &c); err != nil {
+			t.Errorf("limit %d: cause isn't JSON %s", limit, err)
+			continue
+		}
+		if c.Exit != "1" {
+			t.Errorf("limit %d: got exit %q", limit, c.Exit)
+		}
+		if limit < 32768 && !c.Truncated {
+			t.Errorf("limit %d: stderr wasn't marked truncated", limit)
+		}
+		if !strings.HasSuffix(c.Stderr, "the last line") || !strings.HasSuffix(r.Stderr, c.Stderr) {
+			t.Errorf("limit %d: stderr doesn't keep the end %q", limit, c.Stderr)
+		}
+	}
+
+	r.Stderr = "short"
+	var c struct{ Stderr string }
+	if err := json.Unmarshal([]byte(r.Cause(32768)), &c); err != nil || c.Stderr != "short" {
+		t.Errorf("got stderr %q %v, want it whole", c.Stderr, err)
+	}
+}
+
+func TestCauseTruncatesTemplate(t *testing.T) {
+	t.Setenv("ERROR_MESSAGE_TEMPLATE", "{{.Error}} ошибка ошибка ошибка")
+	r := New()
+	r.SetExit("TIMEOUT")
+	for limit := 0; limit < 40; limit++ {
+		cause := r.Cause(limit)
+		if len(cause) > limit || !utf8.ValidString(cause) || !strings.HasPrefix("TIMEOUT ошибка ошибка ошибка", cause) {
+			t.Errorf("limit %d: got %q", limit, cause)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	const s = "añb€c"
+	tests := []struct {
+		limit int
+		front string
+		back  string
+	}{
+		{0, "", ""},
+		{1, "a", "c"},
+		{2, "a", "c"},
+		{3, "añ", "c"},
+		{4, "añb", "€c"},
+		{5, "añb", "b€c"},
+		{len(s), s, s},
+		{len(s) + 1, s, s},
+	}
+	for _, test := range tests {
+		if got := truncate(s, test.limit); got != test.front {
+			t.Errorf("truncate %d: got %q, want %q", test.limit, got, test.front)
+		}
+		if got := truncateFront(s, test.limit); got != test.back {
+			t.Errorf("truncateFront %d: got %q, want %q", test.limit, got, test.back)
+		}
+	}
+}
@@ -1,18 +1,40 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"math/rand"
+	"net/http"
 	"os"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/sfn"
 	"github.com/blaines/tasque-go/result"
 )
 
+// sfnMaxOutput is the largest task output Step Functions accepts
+const sfnMaxOutput = 262144
+
+// sfnMaxCause is the longest failure cause Step Functions accepts
+const sfnMaxCause = 32768
+
+// GetActivityTask long polls for up to 60 seconds, the HTTP client has to
+// wait longer than that
+const sfnPollTimeout = 70 * time.Second
+
+// sfnPollBackoff is the first delay after a failed poll, doubled for every
+// failure in a row up to sfnPollMaxBackoff
+const (
+	sfnPollBackoff    = time.Second
+	sfnPollMaxBackoff = time.Minute
+)
+
 // SFNHandler hello world
 type SFNHandler struct {
 	client      sfn.SFN
@@ -20,6 +42,10 @@ type SFNHandler struct {
 	taskToken   string
 	activityARN string
 	awsRegion   string
+	aws         *AWSConfig
+	// abandoned is set once Step Functions says the task token has timed out
+	// or is gone, there's no point in reporting anything after that
+	abandoned int32
 }
 
 // SFNClient hello world
@@ -39,92 +65,205 @@ func (handler *SFNHandler) body() *string {
 	return &handler.messageBody
 }
 
+func (handler *SFNHandler) attributes() map[string]string {
+	return nil
+}
+
 func (handler *SFNHandler) initialize() {
 	log.Printf("Configuring handler. activityARN:%s", handler.activityARN)
-	sess, err := session.NewSession(&aws.Config{Region: aws.String(strings.Split(handler.activityARN, ":")[3])})
+	sess, err := handler.aws.session()
 	if err != nil {
 		fmt.Println("failed to create session,", err)
 		panic("failed to create session")
 	}
 
-	// client := sfn.New(sess, &aws.Config{
-	// 	MaxRetries: aws.Int(30),
-	// 	HTTPClient: &http.Client{
-	// 		Timeout: 30 * time.Second,
-	// 	},
-	// })
-	client := sfn.New(sess)
+	// The activity's own region unless one is configured
+	client := sfn.New(sess, handler.aws.clientConfig(handler.aws.SFNEndpoint, strings.Split(handler.activityARN, ":")[3]).
+		WithHTTPClient(&http.Client{
+			Timeout: sfnPollTimeout,
+		}))
 	handler.newClient(*client)
-	handler.activityARN = os.Getenv("TASK_ACTIVITY_ARN")
 }
 
 func (handler *SFNHandler) newClient(client sfn.SFN) {
 	handler.client = client
 }
 
-func (handler *SFNHandler) receive() bool {
-	for {
+func (handler *SFNHandler) receive(ctx context.Context) bool {
+	failures := 0
+	for ctx.Err() == nil {
 		log.Printf("Waiting for SFN activity data from %s", handler.activityARN)
 		hostname, _ := os.Hostname()
 		getActivityTaskParams := &sfn.GetActivityTaskInput{
 			ActivityArn: aws.String(handler.activityARN),
 			WorkerName:  aws.String(hostname),
 		}
-		receiveMessageResponse, receiveMessageError := handler.client.GetActivityTask(getActivityTaskParams)
+		receiveMessageResponse, receiveMessageError := handler.client.GetActivityTaskWithContext(ctx, getActivityTaskParams)
 
-		if receiveMessageError != nil {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Fatal("E: ", receiveMessageError.Error())
+		if ctx.Err() != nil {
+			// A task that arrived as the poll was cancelled goes back to
+			// the state machine
+			if receiveMessageError == nil && receiveMessageResponse.TaskToken != nil {
+				handler.taskToken = *receiveMessageResponse.TaskToken
+				atomic.StoreInt32(&handler.abandoned, 0)
+				log.Printf("I: Releasing task %s received while shutting down", *handler.id())
+				releaseMessage(handler)
+			}
 			return false
 		}
+		if receiveMessageError != nil {
+			if awsErr, ok := receiveMessageError.(awserr.Error); ok && isSFNConfigurationError(awsErr.Code()) {
+				log.Fatal("E: ", receiveMessageError.Error())
+			}
+			failures++
+			delay := sfnPollDelay(failures)
+			log.Printf("E: Polling %s failed %d times in a row, retrying in %s %s", handler.activityARN, failures, delay, receiveMessageError)
+			select {
+			case <-ctx.Done():
+				return false
+			case <-time.After(delay):
+			}
+			continue
+		}
+		failures = 0
 
 		if receiveMessageResponse.TaskToken != nil {
 			handler.messageBody = *receiveMessageResponse.Input
 			handler.taskToken = *receiveMessageResponse.TaskToken
+			atomic.StoreInt32(&handler.abandoned, 0)
 
-			writeFileError := ioutil.WriteFile("payload.json", []byte(handler.messageBody), 0644)
-			if writeFileError != nil {
-				panic(writeFileError)
-			}
 			return true
 		}
 	}
+	return false
+}
+
+// isSFNConfigurationError says whether polling can never succeed, as
+// opposed to throttling, 5xx responses and timeouts which pass
+func isSFNConfigurationError(code string) bool {
+	switch code {
+	case sfn.ErrCodeActivityDoesNotExist, sfn.ErrCodeInvalidArn:
+		return true
+	}
+	return false
+}
+
+// sfnPollDelay is sfnPollBackoff doubled for every failure after the first,
+// with up to half of it taken off at random so that workers don't all retry
+// at once
+func sfnPollDelay(failures int) time.Duration {
+	delay := sfnPollBackoff
+	for i := 1; i < failures && delay < sfnPollMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > sfnPollMaxBackoff {
+		delay = sfnPollMaxBackoff
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
 }
 
-func (handler *SFNHandler) success() {
+// success reports the worker's output, see TASK_OUTPUT_FILE, or the input
+// when the worker didn't write any
+func (handler *SFNHandler) success(ctx context.Context, result result.Result) {
+	if err := handler.sendSuccess(ctx, result); err != nil && err != errAbandoned {
+		log.Printf("Couldn't send task success %+v", err)
+	}
+}
+
+// sendSuccess is success returning whether Step Functions got the result,
+// errAbandoned when the task timed out or no longer exists
+func (handler *SFNHandler) sendSuccess(ctx context.Context, result result.Result) error {
+	if handler.isAbandoned() {
+		return errAbandoned
+	}
+	output := handler.messageBody
+	if result.Output != "" {
+		output = result.Output
+	}
+	if len(output) > sfnMaxOutput || !json.Valid([]byte(output)) {
+		log.Printf("E: Task output is not JSON or larger than %d bytes", sfnMaxOutput)
+		result.SetExit("OUTPUT")
+		return handler.sendFailure(ctx, result.Error, result.Cause(sfnMaxCause))
+	}
 	sendTaskSuccessParams := &sfn.SendTaskSuccessInput{
-		Output:    aws.String(handler.messageBody),
+		Output:    aws.String(output),
 		TaskToken: aws.String(handler.taskToken),
 	}
-	_, deleteMessageError := handler.client.SendTaskSuccess(sendTaskSuccessParams)
+	_, sendTaskSuccessError := handler.client.SendTaskSuccessWithContext(ctx, sendTaskSuccessParams)
+	return handler.reportError(sendTaskSuccessError)
+}
 
-	if deleteMessageError != nil {
-		return
+func (handler *SFNHandler) failure(ctx context.Context, err result.Result) {
+	if sendErr := handler.sendFailure(ctx, err.Error, err.Cause(sfnMaxCause)); sendErr != nil && sendErr != errAbandoned {
+		log.Printf("Couldn't send task failure %+v", sendErr)
 	}
 }
 
-func (handler *SFNHandler) failure(err result.Result) {
+// sendFailure fails the task, returning errAbandoned like sendSuccess
+func (handler *SFNHandler) sendFailure(ctx context.Context, errorName string, cause string) error {
+	if handler.isAbandoned() {
+		return errAbandoned
+	}
 	sendTaskFailureParams := &sfn.SendTaskFailureInput{
 		TaskToken: aws.String(handler.taskToken),
-		Error:     aws.String(err.Error),
-		Cause:     aws.String(err.Message()),
+		Error:     aws.String(errorName),
+		Cause:     aws.String(cause),
 	}
-	_, deleteMessageError := handler.client.SendTaskFailure(sendTaskFailureParams)
+	_, sendTaskFailureError := handler.client.SendTaskFailureWithContext(ctx, sendTaskFailureParams)
+	return handler.reportError(sendTaskFailureError)
+}
 
-	if deleteMessageError != nil {
-		log.Printf("Couldn't send task failure %+v", deleteMessageError)
-		return
+// reportError turns the errors for a task that timed out or no longer
+// exists into errAbandoned
+func (handler *SFNHandler) reportError(err error) error {
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case sfn.ErrCodeTaskTimedOut, sfn.ErrCodeTaskDoesNotExist:
+			atomic.StoreInt32(&handler.abandoned, 1)
+			return errAbandoned
+		}
 	}
+	return err
 }
 
-func (handler *SFNHandler) heartbeat() {
+// heartbeat returns errAbandoned once the task has timed out or no longer
+// exists, e.g. because its execution was stopped
+func (handler *SFNHandler) heartbeat(ctx context.Context) error {
 	sendTaskHeartbeatParams := &sfn.SendTaskHeartbeatInput{
 		TaskToken: aws.String(handler.taskToken),
 	}
-	_, deleteMessageError := handler.client.SendTaskHeartbeat(sendTaskHeartbeatParams)
+	_, sendTaskHeartbeatError := handler.client.SendTaskHeartbeatWithContext(ctx, sendTaskHeartbeatParams)
+
+	if err := handler.reportError(sendTaskHeartbeatError); err != nil {
+		if err == errAbandoned {
+			return err
+		}
+		log.Printf("Couldn't send task heartbeat %+v", err)
+	}
+	return nil
+}
+
+func (handler *SFNHandler) isAbandoned() bool {
+	if atomic.LoadInt32(&handler.abandoned) == 1 {
+		log.Printf("I: Task %s timed out or no longer exists, not reporting its result", *handler.id())
+		return true
+	}
+	return false
+}
+
+// discard fails the task with Quarantined, which a state machine shouldn't
+// retry
+func (handler *SFNHandler) discard(ctx context.Context, err result.Result) {
+	if sendErr := handler.sendFailure(ctx, "Quarantined", err.Cause(sfnMaxCause)); sendErr != nil && sendErr != errAbandoned {
+		log.Printf("Couldn't send task failure %+v", sendErr)
+	}
+}
 
-	if deleteMessageError != nil {
-		return
+// release fails the task with WorkerShutdown so the state machine can retry it
+func (handler *SFNHandler) release(ctx context.Context) {
+	hostname, _ := os.Hostname()
+	cause := fmt.Sprintf("Worker %s shut down before the task finished", hostname)
+	if err := handler.sendFailure(ctx, "WorkerShutdown", cause); err != nil && err != errAbandoned {
+		log.Printf("Couldn't send task failure %+v", err)
 	}
 }
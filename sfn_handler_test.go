@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sfn"
+)
+
+// newFakeSFN is a Step Functions endpoint that answers heartbeats with
+// heartbeatError, and the calls it got
+func newFakeSFN(t *testing.T, heartbeatError string) (*sfn.SFN, func() []string) {
+	var mu sync.Mutex
+	var calls []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AWSStepFunctions.")
+		mu.Lock()
+		calls = append(calls, call)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		if call == "SendTaskHeartbeat" && heartbeatError != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"` + heartbeatError + `","message":"gone"}`))
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(server.Close)
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+	return sfn.New(sess), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, calls...)
+	}
+}
+
+func TestSFNAbandonedTaskIsStopped(t *testing.T) {
+	for _, code := range []string{sfn.ErrCodeTaskTimedOut, sfn.ErrCodeTaskDoesNotExist} {
+		client, calls := newFakeSFN(t, code)
+		handler := &SFNHandler{taskToken: strings.Repeat("t", 64), messageBody: "{}"}
+		handler.newClient(*client)
+		tasque := &Tasque{Heartbeat: 100 * time.Millisecond}
+		tasque.taskCtx, tasque.stopTasks = context.WithCancel(context.Background())
+		executable := &Executable{binary: "sh", arguments: []string{"-c", "sleep 30"}, timeout: time.Minute, killGrace: time.Second}
+
+		started := time.Now()
+		tasque.execute(handler, executable)
+		tasque.stopTasks()
+		if took := time.Since(started); took > 5*time.Second {
+			t.Errorf("%s: the task ran for %s", code, took)
+		}
+		got := calls()
+		if len(got) != 1 || got[0] != "SendTaskHeartbeat" {
+			t.Errorf("%s: got calls %q, want only the heartbeat", code, got)
+		}
+		// A result that comes in anyway isn't sent either
+		handler.success(context.Background(), executable.Result())
+		if got := calls(); len(got) != 1 {
+			t.Errorf("%s: got calls %q after the task was abandoned", code, got)
+		}
+	}
+
+	// Other heartbeat errors leave the task running
+	client, calls := newFakeSFN(t, "ThrottlingException")
+	handler := &SFNHandler{taskToken: strings.Repeat("t", 64), messageBody: "{}"}
+	handler.newClient(*client)
+	tasque := &Tasque{Heartbeat: 100 * time.Millisecond}
+	tasque.taskCtx, tasque.stopTasks = context.WithCancel(context.Background())
+	defer tasque.stopTasks()
+	executable := &Executable{binary: "sh", arguments: []string{"-c", "sleep 0.5"}, timeout: time.Minute, killGrace: time.Second}
+	tasque.execute(handler, executable)
+	if exit := executable.Result().Exit; exit != "0" {
+		t.Errorf("got exit %q, want the task to finish", exit)
+	}
+	if got := calls(); got[len(got)-1] != "SendTaskSuccess" {
+		t.Errorf("got calls %q, want a success last", got)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+)
+
+// snsEnvelope is what SNS delivers to a queue subscribed without raw message
+// delivery
+type snsEnvelope struct {
+	Type              string
+	MessageID         string `json:"MessageId"`
+	TopicArn          string
+	Subject           string
+	Message           string
+	Timestamp         string
+	SignatureVersion  string
+	Signature         string
+	MessageAttributes map[string]struct {
+		Type  string
+		Value string
+	}
+}
+
+// parseSNSEnvelope recognises an SNS Notification in an SQS message body
+func parseSNSEnvelope(body string) (*snsEnvelope, bool) {
+	envelope := &snsEnvelope{}
+	if err := json.Unmarshal([]byte(body), envelope); err != nil {
+		return nil, false
+	}
+	if envelope.Type != "Notification" || envelope.TopicArn == "" {
+		return nil, false
+	}
+	return envelope, true
+}
+
+// attributes are the topic ARN, subject, SNS message ID and the SNS message
+// attributes, which the worker gets along with the SQS ones
+func (envelope *snsEnvelope) attributes() map[string]string {
+	attributes := map[string]string{
+		"TopicArn":     envelope.TopicArn,
+		"SnsMessageId": envelope.MessageID,
+	}
+	if envelope.Subject != "" {
+		attributes["Subject"] = envelope.Subject
+	}
+	for name, attribute := range envelope.MessageAttributes {
+		attributes[name] = attribute.Value
+	}
+	return attributes
+}
+
+// loadSNSCertificate reads the PEM encoded certificate SNS signs with
+func loadSNSCertificate(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM certificate", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// verify checks the notification's signature, see
+// https://docs.aws.amazon.com/sns/latest/dg/sns-verify-signature-of-message.html
+func (envelope *snsEnvelope) verify(certificate *x509.Certificate) error {
+	publicKey, ok := certificate.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("SNS certificate doesn't have an RSA key")
+	}
+	signature, err := base64.StdEncoding.DecodeString(envelope.Signature)
+	if err != nil {
+		return err
+	}
+	signed := "Message\n" + envelope.Message + "\n" + "MessageId\n" + envelope.MessageID + "\n"
+	if envelope.Subject != "" {
+		signed += "Subject\n" + envelope.Subject + "\n"
+	}
+	signed += "Timestamp\n" + envelope.Timestamp + "\n" + "TopicArn\n" + envelope.TopicArn + "\n" + "Type\n" + envelope.Type + "\n"
+
+	switch envelope.SignatureVersion {
+	case "1":
+		digest := sha1.Sum([]byte(signed))
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA1, digest[:], signature)
+	case "2":
+		digest := sha256.Sum256([]byte(signed))
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature)
+	}
+	return fmt.Errorf("Unknown SNS signature version %q", envelope.SignatureVersion)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+// signSNS signs the envelope the way SNS does
+func signSNS(t *testing.T, key *rsa.PrivateKey, envelope *snsEnvelope) {
+	signed := "Message\n" + envelope.Message + "\n" + "MessageId\n" + envelope.MessageID + "\n"
+	if envelope.Subject != "" {
+		signed += "Subject\n" + envelope.Subject + "\n"
+	}
+	signed += "Timestamp\n" + envelope.Timestamp + "\n" + "TopicArn\n" + envelope.TopicArn + "\n" + "Type\n" + envelope.Type + "\n"
+	var signature []byte
+	var err error
+	if envelope.SignatureVersion == "1" {
+		digest := sha1.Sum([]byte(signed))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA1, digest[:])
+	} else {
+		digest := sha256.Sum256([]byte(signed))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.Signature = base64.StdEncoding.EncodeToString(signature)
+}
+
+func TestSNSEnvelopeVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := &x509.Certificate{PublicKey: &key.PublicKey}
+	notification := func(version string, subject string) *snsEnvelope {
+		return &snsEnvelope{
+			Type:             "Notification",
+			MessageID:        "165545c9-2a5c-472c-8df2-7ff2be2b3b1b",
+			TopicArn:         "arn:aws:sns:us-east-1:123456789012:tasks",
+			Subject:          subject,
+			Message:          `{"a":1}`,
+			Timestamp:        "2026-10-17T12:00:00.000Z",
+			SignatureVersion: version,
+		}
+	}
+
+	for _, version := range []string{"1", "2"} {
+		for _, subject := range []string{"", "Hello"} {
+			envelope := notification(version, subject)
+			signSNS(t, key, envelope)
+			if err := envelope.verify(certificate); err != nil {
+				t.Errorf("version %s, subject %q: %s", version, subject, err)
+			}
+			envelope.Message = `{"a":2}`
+			if err := envelope.verify(certificate); err == nil {
+				t.Errorf("version %s, subject %q: verified a changed message", version, subject)
+			}
+		}
+	}
+
+	envelope := notification("2", "")
+	signSNS(t, other, envelope)
+	if err := envelope.verify(certificate); err == nil {
+		t.Error("verified a signature by another key")
+	}
+	envelope = notification("3", "")
+	signSNS(t, key, envelope)
+	if err := envelope.verify(certificate); err == nil {
+		t.Error("verified an unknown signature version")
+	}
+	envelope = notification("2", "")
+	envelope.Signature = "not base64!"
+	if err := envelope.verify(certificate); err == nil {
+		t.Error("verified a signature that isn't base64")
+	}
+}
+
+func TestUnwrapSNS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope := &snsEnvelope{
+		Type:             "Notification",
+		MessageID:        "165545c9-2a5c-472c-8df2-7ff2be2b3b1b",
+		TopicArn:         "arn:aws:sns:us-east-1:123456789012:tasks",
+		Message:          `{"a":1}`,
+		Timestamp:        "2026-10-17T12:00:00.000Z",
+		SignatureVersion: "2",
+	}
+	signSNS(t, key, envelope)
+	envelope.MessageAttributes = map[string]struct {
+		Type  string
+		Value string
+	}{
+		"MessageGroupId": {"String", "sns-group"},
+		"Color":          {"String", "blue"},
+	}
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := func(body string) *SQSMessage {
+		return &SQSMessage{messageID: "m", messageBody: body, messageAttributes: map[string]string{"MessageGroupId": "sqs-group"}}
+	}
+
+	handler := &SQSHandler{}
+	raw := message(`{"a":1}`)
+	if err := handler.unwrapSNS(raw); err != nil || raw.messageBody != `{"a":1}` {
+		t.Errorf("without a certificate a raw message should pass, got %q %v", raw.messageBody, err)
+	}
+
+	handler.snsCertificate = &x509.Certificate{PublicKey: &key.PublicKey}
+	if err := handler.unwrapSNS(message(`{"a":1}`)); err == nil {
+		t.Error("with a certificate a raw message passed")
+	}
+	notification := message(string(body))
+	if err := handler.unwrapSNS(notification); err != nil {
+		t.Fatal(err)
+	}
+	if notification.messageBody != `{"a":1}` {
+		t.Errorf("got body %q", notification.messageBody)
+	}
+	if got := notification.messageAttributes["MessageGroupId"]; got != "sqs-group" {
+		t.Errorf("SNS overrode MessageGroupId with %q", got)
+	}
+	if got := notification.messageAttributes["Color"]; got != "blue" {
+		t.Errorf("got Color %q", got)
+	}
+}
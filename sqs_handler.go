@@ -1,27 +1,100 @@
 package main
 
 import (
-	"io/ioutil"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sfn"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 	"github.com/blaines/tasque-go/result"
 )
 
+// sqsMaxVisibility is the longest visibility timeout SQS accepts
+const sqsMaxVisibility = 12 * time.Hour
+
+// sqsMaxBatch is the most messages SQS receives or deletes in one request
+const sqsMaxBatch = 10
+
+// sqsAckInterval is how long a successful message waits for others to be
+// deleted in the same batch
+const sqsAckInterval = time.Second
+
 // SQSHandler hello world
 type SQSHandler struct {
-	client        sqsiface.SQSAPI
+	client    sqsiface.SQSAPI
+	queueURL  string
+	awsRegion string
+	aws       *AWSConfig
+	// visibilityTimeout is how many seconds each heartbeat keeps the
+	// message hidden from other workers
+	visibilityTimeout int64
+	// retryDelay is the first failure's redelivery delay, doubled for every
+	// receive after that up to maxRetryDelay
+	retryDelay    time.Duration
+	maxRetryDelay time.Duration
+	// batchSize is the most messages receiveBatch asks for
+	batchSize int
+	// resultQueueURL gets a sqsResult after every task, unless the message
+	// has a ReplyTo attribute naming another queue
+	resultQueueURL string
+	// snsCertificate, if set, has to have signed every SNS notification
+	snsCertificate *x509.Certificate
+	// taskTokenPath, if set, is where messages carry a Step Functions task
+	// token, see callbackMessage
+	taskTokenPath string
+	sfnClient     *sfn.SFN
+	// message is the one receive got, receiveBatch hands out messages of
+	// their own instead
+	message sqsReceived
+	acks    chan sqsAck
+}
+
+// sqsReceived is an *SQSMessage or a *callbackMessage
+type sqsReceived interface {
+	MessageHandler
+	attempts() int
+}
+
+// SQSMessage is one received message, it handles its own success and failure
+type SQSMessage struct {
+	handler       *SQSHandler
 	messageID     string
 	messageBody   string
 	receiptHandle string
-	queueURL      string
-	awsRegion     string
+	receiveCount  int
+	// messageAttributes holds both the producer's message attributes and
+	// the system attributes
+	messageAttributes map[string]string
+	deleted           bool
+}
+
+// sqsResult is published to the result queue once a task is done
+type sqsResult struct {
+	CorrelationID string `json:"correlationId"`
+	Status        string `json:"status"`
+	Attempt       int    `json:"attempt"`
+	Exit          string `json:"exit"`
+	Error         string `json:"error,omitempty"`
+	Message       string `json:"message,omitempty"`
+	Output        string `json:"output,omitempty"`
+}
+
+// sqsAck is a successful message waiting for DeleteMessageBatch, or with
+// no message a request to delete whatever is waiting
+type sqsAck struct {
+	message *SQSMessage
+	deleted chan error
 }
 
 // SQSClient hello world
@@ -32,68 +105,445 @@ type SQSClient struct {
 }
 
 func (handler *SQSHandler) id() *string {
-	return &handler.messageID
+	return handler.message.id()
 }
 
 func (handler *SQSHandler) body() *string {
-	return &handler.messageBody
+	return handler.message.body()
+}
+
+func (handler *SQSHandler) attributes() map[string]string {
+	return handler.message.attributes()
 }
 
 func (handler *SQSHandler) initialize() {
-	handler.newClient(sqs.New(session.New(), &aws.Config{
-		MaxRetries: aws.Int(30),
-		HTTPClient: &http.Client{
+	sess, err := handler.aws.session()
+	if err != nil {
+		fmt.Println("failed to create session,", err)
+		panic("failed to create session")
+	}
+	handler.newClient(sqs.New(sess, handler.aws.clientConfig(handler.aws.SQSEndpoint, "").
+		WithMaxRetries(30).
+		WithHTTPClient(&http.Client{
 			Timeout: 30 * time.Second,
-		},
-	}))
-	handler.queueURL = os.Getenv("TASK_QUEUE_URL")
+		})))
+	if handler.taskTokenPath != "" {
+		handler.sfnClient = sfn.New(sess, handler.aws.clientConfig(handler.aws.SFNEndpoint, ""))
+	}
+	handler.acks = make(chan sqsAck, sqsMaxBatch)
+	go handler.acknowledge()
 }
 
 func (handler *SQSHandler) newClient(client sqsiface.SQSAPI) {
 	handler.client = client
 }
 
-func (handler *SQSHandler) receive() bool {
+func (handler *SQSHandler) receive(ctx context.Context) bool {
+	messages, err := handler.receiveBatch(ctx, 1)
+	if err != nil {
+		log.Println("E: ", err.Error())
+		return false
+	}
+	if len(messages) == 0 {
+		return false
+	}
+	handler.message = messages[0].(sqsReceived)
+	return true
+}
+
+// receiveBatch receives up to max messages, no more than the batch size
+func (handler *SQSHandler) receiveBatch(ctx context.Context, max int) ([]MessageHandler, error) {
+	if max > handler.batchSize {
+		max = handler.batchSize
+	}
+	// The message stays hidden until the first heartbeat, whatever the
+	// queue's own visibility timeout
 	receiveMessageParams := &sqs.ReceiveMessageInput{
-		QueueUrl:            aws.String(handler.queueURL),
-		MaxNumberOfMessages: aws.Int64(1),
-		WaitTimeSeconds:     aws.Int64(20),
+		QueueUrl:              aws.String(handler.queueURL),
+		MaxNumberOfMessages:   aws.Int64(int64(max)),
+		WaitTimeSeconds:       aws.Int64(20),
+		VisibilityTimeout:     aws.Int64(handler.visibilityTimeout),
+		AttributeNames:        []*string{aws.String(sqs.QueueAttributeNameAll)},
+		MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
 	}
-	receiveMessageResponse, receiveMessageError := handler.client.ReceiveMessage(receiveMessageParams)
+	receiveMessageResponse, receiveMessageError := handler.client.ReceiveMessageWithContext(ctx, receiveMessageParams)
 
+	if ctx.Err() != nil {
+		// Messages that arrived as the receive was cancelled go straight back
+		if receiveMessageError == nil {
+			for _, message := range receiveMessageResponse.Messages {
+				log.Printf("I: Releasing message %s received while shutting down", aws.StringValue(message.MessageId))
+				releaseMessage(&SQSMessage{
+					handler:       handler,
+					messageID:     aws.StringValue(message.MessageId),
+					receiptHandle: aws.StringValue(message.ReceiptHandle),
+				})
+			}
+		}
+		return nil, nil
+	}
 	if receiveMessageError != nil {
-		// Print the error, cast err to awserr.Error to get the Code and
-		// Message from an error.
-		log.Println("E: ", receiveMessageError.Error())
-		return false
+		return nil, receiveMessageError
 	}
 	if len(receiveMessageResponse.Messages) == 0 {
 		log.Println("I: ", "No messages retrieved from queue")
-		return false
+		return nil, nil
 	}
 
-	handler.messageBody = *receiveMessageResponse.Messages[0].Body
-	handler.messageID = *receiveMessageResponse.Messages[0].MessageId
-	handler.receiptHandle = *receiveMessageResponse.Messages[0].ReceiptHandle
+	var messages []MessageHandler
+	for _, message := range receiveMessageResponse.Messages {
+		receiveCount, _ := strconv.Atoi(aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+		sqsMessage := &SQSMessage{
+			handler:           handler,
+			messageBody:       aws.StringValue(message.Body),
+			messageID:         aws.StringValue(message.MessageId),
+			receiptHandle:     aws.StringValue(message.ReceiptHandle),
+			receiveCount:      receiveCount,
+			messageAttributes: messageAttributes(message),
+		}
+		if err := handler.unwrapSNS(sqsMessage); err != nil {
+			// Left alone it ends up in the dead letter queue, if there is one
+			log.Printf("E: Message %s %s", sqsMessage.messageID, err)
+			continue
+		}
+		if handler.taskTokenPath != "" {
+			callback, err := handler.newCallbackMessage(sqsMessage)
+			if err != nil {
+				log.Printf("E: Message %s %s", sqsMessage.messageID, err)
+				continue
+			}
+			messages = append(messages, callback)
+			continue
+		}
+		messages = append(messages, sqsMessage)
+	}
+	return messages, nil
+}
+
+func (handler *SQSHandler) success(ctx context.Context, result result.Result) {
+	handler.message.success(ctx, result)
+}
+
+func (handler *SQSHandler) failure(ctx context.Context, err result.Result) {
+	handler.message.failure(ctx, err)
+}
+
+func (handler *SQSHandler) heartbeat(ctx context.Context) error {
+	return handler.message.heartbeat(ctx)
+}
 
-	writeFileError := ioutil.WriteFile("payload.json", []byte(handler.messageBody), 0644)
-	if writeFileError != nil {
-		panic(writeFileError)
+func (handler *SQSHandler) release(ctx context.Context) {
+	handler.message.release(ctx)
+}
+
+func (handler *SQSHandler) discard(ctx context.Context, err result.Result) {
+	handler.message.discard(ctx, err)
+}
+
+func (handler *SQSHandler) attempts() int {
+	return handler.message.attempts()
+}
+
+// acknowledge deletes successful messages in batches of up to ten, waiting
+// at most sqsAckInterval for a batch to fill up. A message of an ordered
+// group holds up the rest of it, so its batch goes at once.
+func (handler *SQSHandler) acknowledge() {
+	var pending []sqsAck
+	var flush <-chan time.Time
+	for {
+		select {
+		case ack := <-handler.acks:
+			if ack.message == nil {
+				if len(pending) > 0 {
+					handler.deleteBatch(pending)
+				}
+				pending = nil
+				flush = nil
+				ack.deleted <- nil
+				continue
+			}
+			pending = append(pending, ack)
+			if len(pending) == 1 {
+				flush = time.After(sqsAckInterval)
+			}
+			if len(pending) < sqsMaxBatch && ack.message.group() == "" {
+				continue
+			}
+		case <-flush:
+		}
+		handler.deleteBatch(pending)
+		pending = nil
+		flush = nil
+	}
+}
+
+// deleteBatch deletes the messages and tells each of them how that went
+func (handler *SQSHandler) deleteBatch(acks []sqsAck) {
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	var entries []*sqs.DeleteMessageBatchRequestEntry
+	for i, ack := range acks {
+		entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(i)),
+			ReceiptHandle: aws.String(ack.message.receiptHandle),
+		})
+	}
+	deleteMessageBatchParams := &sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(handler.queueURL),
+		Entries:  entries,
+	}
+	deleteMessageBatchResponse, deleteMessageBatchError := handler.client.DeleteMessageBatchWithContext(ctx, deleteMessageBatchParams)
+
+	errs := make([]error, len(acks))
+	if deleteMessageBatchError != nil {
+		for i := range errs {
+			errs[i] = deleteMessageBatchError
+		}
+	} else {
+		for _, failed := range deleteMessageBatchResponse.Failed {
+			i, _ := strconv.Atoi(aws.StringValue(failed.Id))
+			errs[i] = fmt.Errorf("%s: %s", aws.StringValue(failed.Code), aws.StringValue(failed.Message))
+		}
+	}
+	for i, ack := range acks {
+		if errs[i] != nil {
+			log.Printf("Couldn't delete message %s %+v", ack.message.messageID, errs[i])
+		}
+		ack.deleted <- errs[i]
+	}
+}
+
+// flush deletes the successful messages still waiting for a batch, before
+// tasque exits
+func (handler *SQSHandler) flush() {
+	if handler.acks == nil {
+		return
+	}
+	flushed := make(chan error, 1)
+	handler.acks <- sqsAck{deleted: flushed}
+	<-flushed
+}
+
+// unwrapSNS replaces the body of a message delivered by an SNS subscription
+// with the notification's Message, and adds the topic ARN and the SNS
+// message attributes to the message's attributes. Once there is an SNS
+// certificate every message has to be a notification signed with it.
+func (handler *SQSHandler) unwrapSNS(message *SQSMessage) error {
+	envelope, ok := parseSNSEnvelope(message.messageBody)
+	if !ok {
+		if handler.snsCertificate != nil {
+			return fmt.Errorf("is not an SNS notification")
+		}
+		return nil
+	}
+	if handler.snsCertificate != nil {
+		if err := envelope.verify(handler.snsCertificate); err != nil {
+			return fmt.Errorf("SNS signature verification failed %s", err)
+		}
+	}
+	message.messageBody = envelope.Message
+	// SQS's own attributes, e.g. MessageGroupId, win
+	for name, value := range envelope.attributes() {
+		if _, ok := message.messageAttributes[name]; !ok {
+			message.messageAttributes[name] = value
+		}
 	}
+	return nil
+}
+
+// messageAttributes merges the message's system attributes, e.g.
+// ApproximateReceiveCount or MessageGroupId, with its message attributes.
+// Binary values are base64 encoded.
+func messageAttributes(message *sqs.Message) map[string]string {
+	attributes := map[string]string{}
+	for name, value := range message.Attributes {
+		attributes[name] = aws.StringValue(value)
+	}
+	for name, value := range message.MessageAttributes {
+		if value.StringValue != nil {
+			attributes[name] = aws.StringValue(value.StringValue)
+		} else {
+			attributes[name] = base64.StdEncoding.EncodeToString(value.BinaryValue)
+		}
+	}
+	return attributes
+}
+
+func (message *SQSMessage) id() *string {
+	return &message.messageID
+}
+
+func (message *SQSMessage) body() *string {
+	return &message.messageBody
+}
+
+func (message *SQSMessage) attributes() map[string]string {
+	return message.messageAttributes
+}
+
+// initialize and receive have nothing to do, the message has been received
+// by its SQSHandler
+func (message *SQSMessage) initialize() {}
+
+func (message *SQSMessage) receive(ctx context.Context) bool {
 	return true
 }
 
-func (handler *SQSHandler) success() {
-	deleteMessageParams := &sqs.DeleteMessageInput{
-		QueueUrl:      aws.String(handler.queueURL),
-		ReceiptHandle: aws.String(handler.receiptHandle),
+// success publishes the result, then queues the message for the next
+// DeleteMessageBatch and waits for it
+func (message *SQSMessage) success(ctx context.Context, result result.Result) {
+	message.reply(ctx, "success", result)
+	message.delete(ctx)
+}
+
+// discard deletes a quarantined message
+func (message *SQSMessage) discard(ctx context.Context, err result.Result) {
+	message.reply(ctx, "quarantined", err)
+	message.delete(ctx)
+}
+
+func (message *SQSMessage) attempts() int {
+	return message.receiveCount
+}
+
+// delete queues the message for the next DeleteMessageBatch. Only a message
+// of an ordered group waits for it, the next one of the group mustn't start
+// before this one is gone.
+func (message *SQSMessage) delete(ctx context.Context) {
+	ack := sqsAck{message: message, deleted: make(chan error, 1)}
+	select {
+	case message.handler.acks <- ack:
+	case <-ctx.Done():
+		return
+	}
+	if message.group() == "" {
+		return
+	}
+	if deleteMessageError := <-ack.deleted; deleteMessageError != nil {
+		return
+	}
+	message.deleted = true
+}
+
+// group is the message's MessageGroupId, empty unless it's from a FIFO queue
+func (message *SQSMessage) group() string {
+	return message.messageAttributes[sqs.MessageSystemAttributeNameMessageGroupId]
+}
+
+func (message *SQSMessage) succeeded() bool {
+	return message.deleted
+}
+
+// failure makes the message visible again after a backoff delay instead of
+// waiting out the rest of the visibility timeout
+func (message *SQSMessage) failure(ctx context.Context, err result.Result) {
+	message.reply(ctx, "failure", err)
+	delay := message.backoff(err)
+	log.Printf("I: Message %s will be retried in %s (receive %d)", message.messageID, delay, message.receiveCount)
+	message.changeVisibility(ctx, int64(delay.Seconds()), "Couldn't change message visibility")
+}
+
+// reply publishes the task's result with the message's MessageId as the
+// correlation ID, to the queue named by the message's ReplyTo attribute or
+// else the result queue
+func (message *SQSMessage) reply(ctx context.Context, status string, r result.Result) {
+	queueURL := message.handler.resultQueueURL
+	if replyTo := message.messageAttributes["ReplyTo"]; replyTo != "" {
+		queueURL = replyTo
+	}
+	if queueURL == "" {
+		return
+	}
+	reply := sqsResult{
+		CorrelationID: message.messageID,
+		Status:        status,
+		Attempt:       message.receiveCount,
+		Exit:          r.Exit,
+		Output:        r.Output,
+	}
+	if status != "success" {
+		reply.Error = r.Error
+		reply.Message = r.Message()
 	}
-	_, deleteMessageError := handler.client.DeleteMessage(deleteMessageParams)
+	replyBody, _ := json.Marshal(reply)
+	sendMessageParams := &sqs.SendMessageInput{
+		QueueUrl:    aws.String(queueURL),
+		MessageBody: aws.String(string(replyBody)),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"CorrelationId": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(message.messageID),
+			},
+		},
+	}
+	// One reply per attempt
+	fifoSend(sendMessageParams, message.group(), message.messageID, fmt.Sprintf("%s-%d", message.messageID, message.receiveCount))
+	_, sendMessageError := message.handler.client.SendMessageWithContext(ctx, sendMessageParams)
 
-	if deleteMessageError != nil {
+	if sendMessageError != nil {
+		log.Printf("Couldn't send result of %s to %s %+v", message.messageID, queueURL, sendMessageError)
 		return
 	}
 }
 
-func (handler *SQSHandler) failure(err result.Result) {}
-func (handler *SQSHandler) heartbeat()                {}
+// fifoSend fills in what sending to a FIFO queue takes, if input's queue is
+// one: the message's group, or a group of its own, and the deduplication ID
+func fifoSend(input *sqs.SendMessageInput, group string, messageID string, deduplicationID string) {
+	if !strings.HasSuffix(aws.StringValue(input.QueueUrl), ".fifo") {
+		return
+	}
+	if group == "" {
+		group = messageID
+	}
+	input.MessageGroupId = aws.String(group)
+	input.MessageDeduplicationId = aws.String(deduplicationID)
+}
+
+// backoff doubles the base delay for every earlier receive of the message.
+// RETRY_<exit> overrides the base delay for one kind of failure, e.g.
+// RETRY_TIMEOUT=0s or RETRY_MEMORY=10m, the same way EXIT_<exit> translates
+// it.
+func (message *SQSMessage) backoff(err result.Result) time.Duration {
+	handler := message.handler
+	delay := handler.retryDelay
+	if retry := os.Getenv(fmt.Sprintf("RETRY_%s", err.Exit)); retry != "" {
+		if d, parseError := time.ParseDuration(retry); parseError == nil {
+			delay = d
+		} else {
+			log.Printf("Invalid RETRY_%s %s", err.Exit, parseError)
+		}
+	}
+	for i := 1; i < message.receiveCount && delay < handler.maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > handler.maxRetryDelay {
+		delay = handler.maxRetryDelay
+	}
+	return delay
+}
+
+// heartbeat extends the message's visibility timeout so that it isn't
+// delivered to another worker while this one is still running it
+func (message *SQSMessage) heartbeat(ctx context.Context) error {
+	message.changeVisibility(ctx, message.handler.visibilityTimeout, "Couldn't extend message visibility")
+	return nil
+}
+
+// release makes the message visible again so another worker can pick it up
+func (message *SQSMessage) release(ctx context.Context) {
+	message.changeVisibility(ctx, 0, "Couldn't release message")
+}
+
+func (message *SQSMessage) changeVisibility(ctx context.Context, seconds int64, problem string) {
+	changeMessageVisibilityParams := &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(message.handler.queueURL),
+		ReceiptHandle:     aws.String(message.receiptHandle),
+		VisibilityTimeout: aws.Int64(seconds),
+	}
+	_, changeMessageVisibilityError := message.handler.client.ChangeMessageVisibilityWithContext(ctx, changeMessageVisibilityParams)
+
+	if changeMessageVisibilityError != nil {
+		log.Printf("%s %s %+v", problem, message.messageID, changeMessageVisibilityError)
+		return
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/blaines/tasque-go/result"
+)
+
+// fakeSQS records what tasque asks of SQS. failDelete fails the delete of
+// those receipt handles, queued messages are received once.
+type fakeSQS struct {
+	sqsiface.SQSAPI
+	mu         sync.Mutex
+	queued     []*sqs.Message
+	deleted    [][]string
+	visibility map[string][]int64
+	failDelete map[string]bool
+}
+
+func (fake *fakeSQS) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, options ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	fake.mu.Lock()
+	n := int(aws.Int64Value(input.MaxNumberOfMessages))
+	if n > len(fake.queued) {
+		n = len(fake.queued)
+	}
+	output := &sqs.ReceiveMessageOutput{Messages: fake.queued[:n]}
+	fake.queued = fake.queued[n:]
+	fake.mu.Unlock()
+	if n == 0 {
+		// A long poll of an empty queue
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	return output, nil
+}
+
+func (fake *fakeSQS) DeleteMessageBatchWithContext(ctx aws.Context, input *sqs.DeleteMessageBatchInput, options ...request.Option) (*sqs.DeleteMessageBatchOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	output := &sqs.DeleteMessageBatchOutput{}
+	var batch []string
+	for _, entry := range input.Entries {
+		if fake.failDelete[aws.StringValue(entry.ReceiptHandle)] {
+			output.Failed = append(output.Failed, &sqs.BatchResultErrorEntry{Id: entry.Id, Code: aws.String("ReceiptHandleIsInvalid")})
+			continue
+		}
+		batch = append(batch, aws.StringValue(entry.ReceiptHandle))
+	}
+	fake.deleted = append(fake.deleted, batch)
+	return output, nil
+}
+
+func (fake *fakeSQS) ChangeMessageVisibilityWithContext(ctx aws.Context, input *sqs.ChangeMessageVisibilityInput, options ...request.Option) (*sqs.ChangeMessageVisibilityOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.visibility == nil {
+		fake.visibility = map[string][]int64{}
+	}
+	handle := aws.StringValue(input.ReceiptHandle)
+	fake.visibility[handle] = append(fake.visibility[handle], aws.Int64Value(input.VisibilityTimeout))
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func (fake *fakeSQS) visibilities(handle string) []int64 {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return append([]int64{}, fake.visibility[handle]...)
+}
+
+func (fake *fakeSQS) pending() int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return len(fake.queued)
+}
+
+func (fake *fakeSQS) deletes() [][]string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return append([][]string{}, fake.deleted...)
+}
+
+// newFakeSQSHandler is an SQSHandler as initialize sets it up, on fake
+func newFakeSQSHandler(fake *fakeSQS) *SQSHandler {
+	handler := &SQSHandler{queueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/tasks", batchSize: sqsMaxBatch, visibilityTimeout: 60}
+	handler.newClient(fake)
+	handler.acks = make(chan sqsAck, sqsMaxBatch)
+	go handler.acknowledge()
+	return handler
+}
+
+func TestSQSMessageBackoff(t *testing.T) {
+	handler := &SQSHandler{retryDelay: 30 * time.Second, maxRetryDelay: 15 * time.Minute}
+	tests := []struct {
+		receiveCount int
+		exit         string
+		retry        string
+		want         time.Duration
+	}{
+		{1, "1", "", 30 * time.Second},
+		{2, "1", "", time.Minute},
+		{3, "1", "", 2 * time.Minute},
+		{10, "1", "", 15 * time.Minute},
+		{3, "TIMEOUT", "0s", 0},
+		{1, "MEMORY", "10m", 10 * time.Minute},
+		{2, "MEMORY", "10m", 15 * time.Minute},
+		{2, "MEMORY", "later", time.Minute},
+	}
+	for _, test := range tests {
+		if test.retry != "" {
+			t.Setenv("RETRY_"+test.exit, test.retry)
+		}
+		message := &SQSMessage{handler: handler, receiveCount: test.receiveCount}
+		r := result.New()
+		r.SetExit(test.exit)
+		if got := message.backoff(r); got != test.want {
+			t.Errorf("receive %d, exit %s, RETRY_%s=%q: got %s, want %s", test.receiveCount, test.exit, test.exit, test.retry, got, test.want)
+		}
+	}
+}
+
+func TestSQSMessageDelete(t *testing.T) {
+	fake := &fakeSQS{failDelete: map[string]bool{"bad": true}}
+	handler := newFakeSQSHandler(fake)
+	ctx := context.Background()
+
+	// An unordered message doesn't wait for its batch
+	started := time.Now()
+	for _, handle := range []string{"a", "b", "c"} {
+		message := &SQSMessage{handler: handler, messageID: handle, receiptHandle: handle}
+		message.success(ctx, result.New())
+	}
+	if waited := time.Since(started); waited >= sqsAckInterval/2 {
+		t.Errorf("unordered messages waited %s for their delete", waited)
+	}
+	handler.flush()
+	if deletes := fake.deletes(); len(deletes) != 1 || len(deletes[0]) != 3 {
+		t.Errorf("got deletes %q, want one batch of three", deletes)
+	}
+
+	// An ordered message waits, but not for the interval, and knows whether
+	// it's gone
+	group := map[string]string{sqs.MessageSystemAttributeNameMessageGroupId: "g"}
+	ordered := &SQSMessage{handler: handler, messageID: "d", receiptHandle: "d", messageAttributes: group}
+	started = time.Now()
+	ordered.success(ctx, result.New())
+	if !ordered.succeeded() {
+		t.Error("ordered message wasn't deleted")
+	}
+	if waited := time.Since(started); waited >= sqsAckInterval/2 {
+		t.Errorf("ordered message waited %s for its delete", waited)
+	}
+	failed := &SQSMessage{handler: handler, messageID: "bad", receiptHandle: "bad", messageAttributes: group}
+	failed.success(ctx, result.New())
+	if failed.succeeded() {
+		t.Error("ordered message whose delete failed counts as deleted")
+	}
+
+	// A full batch goes out without waiting for the interval
+	for i := 0; i < sqsMaxBatch; i++ {
+		handle := string(rune('e' + i))
+		message := &SQSMessage{handler: handler, messageID: handle, receiptHandle: handle}
+		message.success(ctx, result.New())
+	}
+	deadline := time.Now().Add(sqsAckInterval / 2)
+	for len(fake.deletes()) < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	deletes := fake.deletes()
+	if len(deletes) != 4 || len(deletes[3]) != sqsMaxBatch {
+		t.Errorf("got deletes %q, want a full batch last", deletes)
+	}
+}